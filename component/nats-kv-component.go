@@ -23,15 +23,26 @@ var (
 
 func init() {
 	handler.Exports.HandleMessage = msgHandlerv2
+	keyvaluewatcher.Exports.Watch = watchHandler
 	keyvaluewatcher.Exports.WatchAll = watchAllHandler
 }
 
-func watchAllHandler(kv keyvaluetypes.KeyValueEntry) cm.Result[string, struct{}, string] {
+func watchHandler(event keyvaluetypes.WatchEvent) cm.Result[string, struct{}, string] {
+	logger = wasilog.ContextLogger("NATS-KV-Component-watch")
+	logEvent(event)
+	return cm.OK[cm.Result[string, struct{}, string]](struct{}{})
+}
+
+func watchAllHandler(event keyvaluetypes.WatchEvent) cm.Result[string, struct{}, string] {
 	logger = wasilog.ContextLogger("NATS-KV-Component-watch-all")
-	logger.Info("Got", "key", kv.Key, "value", string(kv.Value.Slice()))
+	logEvent(event)
 	return cm.OK[cm.Result[string, struct{}, string]](struct{}{})
 }
 
+func logEvent(event keyvaluetypes.WatchEvent) {
+	logger.Info("Got", "bucket", event.Bucket, "key", event.Key, "operation", event.Operation.String(), "revision", event.Revision, "value", string(event.Value.Slice()))
+}
+
 func msgHandlerv2(msg types.BrokerMessage) (result cm.Result[string, struct{}, string]) {
 	logger = wasilog.ContextLogger("NATS-KV-Component-request-reply")
 	replyMsg := types.BrokerMessage{
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Mattilsynet/map-nats-kv/bindings/exports/mattilsynet/map_kv/election"
+	"github.com/Mattilsynet/map-nats-kv/bindings/mattilsynet/map_kv/leadership"
+	"github.com/Mattilsynet/map-nats-kv/bindings/mattilsynet/map_kv/types"
+	"github.com/Mattilsynet/map-nats-kv/pkg/lease"
+	"github.com/nats-io/nats.go"
+	wrpc "wrpc.io/go"
+)
+
+// ElectionHandler serves election, campaigns run in the provider and the component is told through leadership when it gains or loses leadership
+type ElectionHandler struct {
+	kvHandler *KvHandler
+}
+
+func NewElectionHandler(kvHandler *KvHandler) *ElectionHandler {
+	return &ElectionHandler{kvHandler: kvHandler}
+}
+
+func (h *ElectionHandler) Campaign(ctx__ context.Context, name string, ttlMs uint64) (*wrpc.Result[struct{}, election.Error], error) {
+	isLinked, target := h.kvHandler.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[struct{}](*errUnauthorized), nil
+	}
+	if ttlMs == 0 {
+		return wrpc.Err[struct{}](*types.NewErrorOther("ttl-ms must be greater than 0")), nil
+	}
+	// INFO: the campaign runs in the background, a name that doesn't make a valid lease key would only ever fail there
+	kv, err := h.kvHandler.getLockKv(target)
+	if err != nil {
+		h.kvHandler.provider.Logger.Error("error getting lock kv", "error", err)
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	if err := lease.CheckName(kv, electionLease(name)); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	h.kvHandler.startCampaign(target, name, time.Duration(ttlMs)*time.Millisecond)
+	return wrpc.Ok[election.Error](struct{}{}), nil
+}
+
+func (h *ElectionHandler) Resign(ctx__ context.Context, name string) (*wrpc.Result[struct{}, election.Error], error) {
+	isLinked, target := h.kvHandler.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[struct{}](*errUnauthorized), nil
+	}
+	h.kvHandler.stopCampaign(target, name)
+	return wrpc.Ok[election.Error](struct{}{}), nil
+}
+
+func electionLease(name string) string {
+	return "election." + name
+}
+
+func campaignKey(target, name string) string {
+	return target + "/" + name
+}
+
+// startCampaign is a no-op if the component is already campaigning under name
+func (ha *KvHandler) startCampaign(target, name string, ttl time.Duration) {
+	ha.campaignsMu.Lock()
+	defer ha.campaignsMu.Unlock()
+	if _, ok := ha.campaigns[campaignKey(target, name)]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ha.campaigns[campaignKey(target, name)] = cancel
+	go ha.campaign(ctx, target, name, ttl)
+}
+
+func (ha *KvHandler) stopCampaign(target, name string) {
+	ha.campaignsMu.Lock()
+	defer ha.campaignsMu.Unlock()
+	if cancel, ok := ha.campaigns[campaignKey(target, name)]; ok {
+		cancel()
+		delete(ha.campaigns, campaignKey(target, name))
+	}
+}
+
+// StopCampaigns resigns every campaign of the component's link
+func (ha *KvHandler) StopCampaigns(target string) {
+	ha.campaignsMu.Lock()
+	defer ha.campaignsMu.Unlock()
+	for key, cancel := range ha.campaigns {
+		if strings.HasPrefix(key, target+"/") {
+			cancel()
+			delete(ha.campaigns, key)
+		}
+	}
+}
+
+// StopAllCampaigns resigns every campaign
+// INFO: releasing the leases is best effort, if the connection is closed first they expire after their ttl instead
+func (ha *KvHandler) StopAllCampaigns() {
+	ha.campaignsMu.Lock()
+	defer ha.campaignsMu.Unlock()
+	for _, cancel := range ha.campaigns {
+		cancel()
+	}
+	clear(ha.campaigns)
+}
+
+// campaign tries to acquire the election lease every third of the ttl, and renews it at the same pace once elected
+// INFO: the holder is this provider instance on behalf of the component, such that only one of the provider replicas calls the component as leader
+func (ha *KvHandler) campaign(ctx context.Context, target, name string, ttl time.Duration) {
+	client := ha.provider.OutgoingRpcClient(componentOf(target))
+	holder := ha.instanceID + "/" + target
+	var held *lease.Lease
+	// INFO: elected is called again on every tick until the component takes it, as a leader that doesn't know it leads nothing
+	announced := false
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		kv, err := ha.getLockKv(target)
+		if err != nil {
+			ha.provider.Logger.Warn("Failed to get lock kv for election", "target", target, "election", name, "error", err)
+		} else if held == nil {
+			held, err = lease.Acquire(kv, electionLease(name), holder, ttl)
+			if err == nil {
+				ha.provider.Logger.Info("Elected", "target", target, "election", name, "token", held.Token)
+				announced = false
+			} else if !errors.Is(err, lease.ErrHeld) {
+				ha.provider.Logger.Warn("Failed to campaign", "target", target, "election", name, "error", err)
+			}
+		} else {
+			var reacquired bool
+			held, reacquired = ha.renewLeadership(ctx, client, kv, target, name, holder, held)
+			announced = announced && !reacquired
+		}
+		// INFO: without a successful renew the lease runs out, and someone else may be elected from then on
+		if held != nil && !time.Now().Before(held.Expires) {
+			ha.provider.Logger.Warn("Lost leadership, lease expired", "target", target, "election", name)
+			held = nil
+			ha.notifyLeadership(ctx, client, target, name, nil)
+		}
+		if held != nil && !announced {
+			announced = ha.notifyLeadership(ctx, client, target, name, held)
+		}
+		select {
+		case <-ctx.Done():
+			if held != nil {
+				if kv != nil {
+					if err := lease.Release(kv, held); err != nil {
+						ha.provider.Logger.Warn("Failed to release election lease, it expires after its ttl instead", "target", target, "election", name, "error", err)
+					}
+				}
+				ha.notifyLeadership(context.Background(), client, target, name, nil)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewLeadership returns the lease to keep holding, nil when it has been taken over, and whether it was acquired anew such that the component has to be told again
+// INFO: transient errors keep the current lease, it's still valid until it expires
+func (ha *KvHandler) renewLeadership(ctx context.Context, client wrpc.Invoker, kv nats.KeyValue, target, name, holder string, held *lease.Lease) (*lease.Lease, bool) {
+	renewed, err := lease.Renew(kv, held)
+	if err == nil {
+		return renewed, false
+	}
+	if !errors.Is(err, nats.ErrKeyExists) && !errors.Is(err, nats.ErrKeyNotFound) {
+		ha.provider.Logger.Warn("Failed to renew leadership, retrying", "target", target, "election", name, "error", err)
+		return held, false
+	}
+	// the revision moved, which is either someone else or an earlier renew of ours whose reply got lost
+	reacquired, err := lease.Acquire(kv, electionLease(name), holder, held.TTL)
+	if err == nil {
+		ha.provider.Logger.Info("Kept leadership with a new token", "target", target, "election", name, "token", reacquired.Token)
+		return reacquired, true
+	}
+	if !errors.Is(err, lease.ErrHeld) {
+		ha.provider.Logger.Warn("Failed to renew leadership, retrying", "target", target, "election", name, "error", err)
+		return held, false
+	}
+	ha.provider.Logger.Warn("Lost leadership", "target", target, "election", name)
+	ha.notifyLeadership(ctx, client, target, name, nil)
+	return nil, false
+}
+
+// notifyLeadership calls elected when held is set and demoted otherwise, it reports whether the component took the call
+func (ha *KvHandler) notifyLeadership(ctx context.Context, client wrpc.Invoker, target, name string, held *lease.Lease) bool {
+	var response *wrpc.Result[struct{}, string]
+	var err error
+	if held != nil {
+		response, err = leadership.Elected(ctx, client, name, held.Token)
+	} else {
+		response, err = leadership.Demoted(ctx, client, name)
+	}
+	if err != nil {
+		ha.provider.Logger.Error("Failed to notify leadership", "target", target, "election", name, "error", err)
+		return false
+	}
+	if response != nil && response.Err != nil {
+		ha.provider.Logger.Error("Failed to notify leadership", "target", target, "election", name, "error", *response.Err)
+		return false
+	}
+	return true
+}
@@ -5,7 +5,10 @@ go 1.23.0
 toolchain go1.23.4
 
 require (
+	github.com/klauspost/compress v1.17.11
 	github.com/nats-io/nats.go v1.39.0
+	github.com/nats-io/nuid v1.0.1
+	github.com/xeipuuv/gojsonschema v1.2.0
 	go.wasmcloud.dev/provider v0.0.6
 	wrpc.io/go v0.1.0
 
@@ -19,9 +22,9 @@ require (
 	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.26.0 // indirect
-	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/nats-io/nkeys v0.4.10 // indirect
-	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/xeipuuv/gojsonpointer v0.0.0-20180127040702-4e3ac2762d5f // indirect
+	github.com/xeipuuv/gojsonreference v0.0.0-20180127040603-bd5ef7bd5415 // indirect
 	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
 	go.opentelemetry.io/otel v1.34.0 // indirect
 	go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc v0.10.0 // indirect
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Mattilsynet/map-nats-kv/bindings/exports/mattilsynet/map_kv/lock"
+	"github.com/Mattilsynet/map-nats-kv/bindings/mattilsynet/map_kv/types"
+	"github.com/Mattilsynet/map-nats-kv/pkg/lease"
+	"github.com/nats-io/nats.go"
+	wrpc "wrpc.io/go"
+)
+
+// LockHandler serves lock, leases are kept in the link's lock_bucket, or "<bucket>-leases" if not set
+// INFO: every replica of a component calls with the same source id, so the lease has no holder, owning a lease means knowing its token
+type LockHandler struct {
+	kvHandler *KvHandler
+}
+
+func NewLockHandler(kvHandler *KvHandler) *LockHandler {
+	return &LockHandler{kvHandler: kvHandler}
+}
+
+func (h *LockHandler) linkedKv(ctx context.Context) (nats.KeyValue, *lock.Error) {
+	isLinked, target := h.kvHandler.isLinkedWith(ctx)
+	if !isLinked {
+		return nil, errUnauthorized
+	}
+	kv, err := h.kvHandler.getLockKv(target)
+	if err != nil {
+		h.kvHandler.provider.Logger.Error("error getting lock kv", "error", err)
+		return nil, natsErrToWit(err)
+	}
+	return kv, nil
+}
+
+func toWitLease(l *lease.Lease) *lock.Lease {
+	return &lock.Lease{
+		Name:    l.Name,
+		Token:   l.Token,
+		TtlMs:   uint64(l.TTL.Milliseconds()),
+		Expires: uint64(l.Expires.UnixNano()),
+	}
+}
+
+func fromWitLease(l *lock.Lease) *lease.Lease {
+	return &lease.Lease{
+		Name:  l.Name,
+		Token: l.Token,
+		TTL:   time.Duration(l.TtlMs) * time.Millisecond,
+	}
+}
+
+func (h *LockHandler) Acquire(ctx__ context.Context, name string, ttlMs uint64) (*wrpc.Result[*lock.Lease, lock.Error], error) {
+	kv, witErr := h.linkedKv(ctx__)
+	if witErr != nil {
+		return wrpc.Err[*lock.Lease](*witErr), nil
+	}
+	// INFO: a lease without ttl would be expired as soon as it's taken, so anyone could take it over
+	if ttlMs == 0 {
+		return wrpc.Err[*lock.Lease](*types.NewErrorOther("ttl-ms must be greater than 0")), nil
+	}
+	l, err := lease.Acquire(kv, name, "", time.Duration(ttlMs)*time.Millisecond)
+	if errors.Is(err, lease.ErrHeld) {
+		return wrpc.Ok[lock.Error]((*lock.Lease)(nil)), nil
+	}
+	if err != nil {
+		h.kvHandler.provider.Logger.Error("error acquiring lock", "name", name, "error", err)
+		return wrpc.Err[*lock.Lease](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[lock.Error](toWitLease(l)), nil
+}
+
+func (h *LockHandler) Renew(ctx__ context.Context, l *lock.Lease) (*wrpc.Result[lock.Lease, lock.Error], error) {
+	kv, witErr := h.linkedKv(ctx__)
+	if witErr != nil {
+		return wrpc.Err[lock.Lease](*witErr), nil
+	}
+	renewed, err := lease.Renew(kv, fromWitLease(l))
+	if err != nil {
+		return wrpc.Err[lock.Lease](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[lock.Error](*toWitLease(renewed)), nil
+}
+
+func (h *LockHandler) Release(ctx__ context.Context, l *lock.Lease) (*wrpc.Result[struct{}, lock.Error], error) {
+	kv, witErr := h.linkedKv(ctx__)
+	if witErr != nil {
+		return wrpc.Err[struct{}](*witErr), nil
+	}
+	if err := lease.Release(kv, fromWitLease(l)); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[lock.Error](struct{}{}), nil
+}
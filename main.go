@@ -64,7 +64,8 @@ func run() error {
 	signalCh := make(chan os.Signal, 1)
 
 	// Handle RPC operations
-	stopFunc, err := server.Serve(p.RPCClient, providerHandler)
+	wasiHandler := NewWasiKvHandler(providerHandler)
+	stopFunc, err := server.Serve(p.RPCClient, providerHandler, NewNamedKvHandler(providerHandler), wasiHandler, wasiHandler, wasiHandler, NewObjectStoreHandler(providerHandler), NewLockHandler(providerHandler), NewElectionHandler(providerHandler))
 	if err != nil {
 		cancel()
 		p.Shutdown()
@@ -99,48 +100,85 @@ func run() error {
 // TODO: handle nats-kv-watcher-interface
 func handleNewSourceLink(ctx context.Context, handler *KvHandler, link provider.InterfaceLinkDefinition) error {
 	handler.provider.Logger.Info("Handling new source link", "link", link)
-	if _, ok := handler.linkedTo[link.Target]; ok {
+	name := sourceLinkName(link.Target, linkPackage(link))
+	if handler.IsLinkedTo(name) {
 		handler.provider.Logger.Warn("Already linked", "target", link.Target)
 		return nil
 	}
-	if !slices.Contains(link.Interfaces, "key-value-watcher") {
-		handler.provider.Logger.Warn("Not a key-value-watcher interface", "interfaces", link.Interfaces)
+	wasiWatcher := isWasiWatcherLink(link)
+	if !wasiWatcher && !slices.Contains(link.Interfaces, "key-value-watcher") {
+		handler.provider.Logger.Warn("Not a key-value-watcher or wasi:keyvalue/watcher interface", "interfaces", link.Interfaces)
 		return nil
 	}
-	handler.linkedTo[link.Target] = link.SourceConfig
-	handler.InitiateNatsWatchAll(link.SourceID, link.Target, config.From(link.SourceConfig), secrets.From(link.SourceSecrets))
-	handler.RegisterComponentWatchAll(ctx, link.SourceID, link.Target)
+	if err := handler.InitiateNatsWatchAll(name, link.Target, config.From(link.SourceConfig), secrets.From(link.SourceSecrets)); err != nil {
+		return err
+	}
+	if err := handler.RegisterComponentWatchAll(ctx, name, link.Target, wasiWatcher); err != nil {
+		handler.DeRegisterComponentWatchAll(name)
+		return err
+	}
+	handler.MarkLinkedTo(name, link.SourceConfig)
 	return nil
 }
 
 func handleNewTargetLink(handler *KvHandler, link provider.InterfaceLinkDefinition) error {
 	handler.provider.Logger.Info("Handling new target link", "link", link)
-	if _, ok := handler.linkedTo[link.Target]; ok {
-		handler.provider.Logger.Info("Already linked", "target", link.Target)
+	name := targetLinkName(link.SourceID, linkPackage(link))
+	if handler.IsLinkedFrom(name) {
+		handler.provider.Logger.Info("Already linked, replacing the link", "sourceId", link.SourceID)
+		handler.StopCampaigns(name)
+		handler.DeRegisterComponent(name)
 	}
-	if !slices.Contains(link.Interfaces, "key-value") {
-		handler.provider.Logger.Info("Not a key-value interface", "interfaces", link.Interfaces)
+	if !isKeyValueLink(link) {
+		handler.provider.Logger.Info("Not a key-value, named-key-value, object-store, lock, election or wasi:keyvalue interface", "interfaces", link.Interfaces)
 		return nil
 	}
-	handler.linkedFrom[link.SourceID] = link.TargetConfig
 	kvConfig := config.From(link.TargetConfig)
 	secrets := secrets.From(link.TargetSecrets)
-	handler.RegisterComponent(link.SourceID, link.Target, kvConfig, secrets)
+	// INFO: the link is only marked as linked once registered, such that requests never see a half registered link
+	if err := handler.RegisterComponent(name, link.Target, kvConfig, secrets); err != nil {
+		return err
+	}
+	handler.MarkLinkedFrom(name, link.TargetConfig)
 	return nil
 }
 
+func isKeyValueLink(link provider.InterfaceLinkDefinition) bool {
+	if link.WitNamespace == "wasi" && link.WitPackage == "keyvalue" {
+		return slices.ContainsFunc(link.Interfaces, func(i string) bool {
+			return i == "store" || i == "atomics" || i == "batch"
+		})
+	}
+	return slices.ContainsFunc(link.Interfaces, func(i string) bool {
+		return i == "key-value" || i == "named-key-value" || i == "object-store" || i == "lock" || i == "election"
+	})
+}
+
+// linkPackage is the package the link is for, links to any map-kv interface share one package
+func linkPackage(link provider.InterfaceLinkDefinition) string {
+	if link.WitNamespace == "wasi" && link.WitPackage == "keyvalue" {
+		return wasiKvPackage
+	}
+	return mapKvPackage
+}
+
+func isWasiWatcherLink(link provider.InterfaceLinkDefinition) bool {
+	return link.WitNamespace == "wasi" && link.WitPackage == "keyvalue" && slices.Contains(link.Interfaces, "watcher")
+}
+
 func handleDelSourceLink(handler *KvHandler, link provider.InterfaceLinkDefinition) error {
 	handler.provider.Logger.Info("Handling del source link", "link", link)
 	handler.provider.Logger.Info("link interfaces", "interfaces", link.Interfaces)
-	handler.DeRegisterComponentWatchAll(link.Target)
-	delete(handler.linkedTo, link.Target)
+	name := sourceLinkName(link.Target, linkPackage(link))
+	handler.DeRegisterComponentWatchAll(name)
 	return nil
 }
 
 func handleDelTargetLink(handler *KvHandler, link provider.InterfaceLinkDefinition) error {
 	handler.provider.Logger.Info("Handling del target link", "link", link)
-	handler.DeRegisterComponent(link.Target)
-	delete(handler.linkedFrom, link.Target)
+	name := targetLinkName(link.SourceID, linkPackage(link))
+	handler.StopCampaigns(name)
+	handler.DeRegisterComponent(name)
 	return nil
 }
 
@@ -150,8 +188,7 @@ func handleHealthCheck(_ *KvHandler) string {
 
 func handleShutdown(handler *KvHandler) error {
 	handler.provider.Logger.Info("Handling shutdown")
+	handler.StopAllCampaigns()
 	handler.DeferAllNatsConnections()
-	clear(handler.linkedFrom)
-	clear(handler.linkedTo)
 	return nil
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Mattilsynet/map-nats-kv/bindings/exports/mattilsynet/map_kv/named_key_value"
+	wrpc "wrpc.io/go"
+)
+
+// NamedKvHandler serves named-key-value, resolving the store name to a bucket through the link's buckets setting
+type NamedKvHandler struct {
+	kvHandler *KvHandler
+}
+
+func NewNamedKvHandler(kvHandler *KvHandler) *NamedKvHandler {
+	return &NamedKvHandler{kvHandler: kvHandler}
+}
+
+func (h *NamedKvHandler) Create(ctx__ context.Context, store string, key string, value []uint8) (*wrpc.Result[struct{}, named_key_value.Error], error) {
+	return h.kvHandler.create(ctx__, store, key, value)
+}
+
+func (h *NamedKvHandler) Get(ctx__ context.Context, store string, key string) (*wrpc.Result[named_key_value.KeyValueEntry, named_key_value.Error], error) {
+	return h.kvHandler.get(ctx__, store, key)
+}
+
+func (h *NamedKvHandler) Put(ctx__ context.Context, store string, key string, value []uint8) (*wrpc.Result[struct{}, named_key_value.Error], error) {
+	return h.kvHandler.put(ctx__, store, key, value)
+}
+
+func (h *NamedKvHandler) Update(ctx__ context.Context, store string, key string, value []uint8, lastRevision uint64) (*wrpc.Result[uint64, named_key_value.Error], error) {
+	return h.kvHandler.update(ctx__, store, key, value, lastRevision)
+}
+
+func (h *NamedKvHandler) Purge(ctx__ context.Context, store string, key string) (*wrpc.Result[struct{}, named_key_value.Error], error) {
+	return h.kvHandler.purge(ctx__, store, key)
+}
+
+func (h *NamedKvHandler) Delete(ctx__ context.Context, store string, key string) (*wrpc.Result[struct{}, named_key_value.Error], error) {
+	return h.kvHandler.delete(ctx__, store, key)
+}
+
+func (h *NamedKvHandler) ListKeys(ctx__ context.Context, store string) (*wrpc.Result[[]string, named_key_value.Error], error) {
+	return h.kvHandler.listKeys(ctx__, store)
+}
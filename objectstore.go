@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/Mattilsynet/map-nats-kv/bindings/exports/mattilsynet/map_kv/object_store"
+	"github.com/nats-io/nats.go"
+	wrpc "wrpc.io/go"
+)
+
+// ObjectStoreHandler serves object-store against the link's object_bucket, values are streamed in chunks by js.ObjectStore
+type ObjectStoreHandler struct {
+	kvHandler *KvHandler
+}
+
+func NewObjectStoreHandler(kvHandler *KvHandler) *ObjectStoreHandler {
+	return &ObjectStoreHandler{kvHandler: kvHandler}
+}
+
+func (h *ObjectStoreHandler) linkedObjectStore(ctx context.Context) (nats.ObjectStore, *object_store.Error) {
+	isLinked, target := h.kvHandler.isLinkedWith(ctx)
+	if !isLinked {
+		return nil, errUnauthorized
+	}
+	link, err := h.kvHandler.link(target)
+	if err != nil {
+		return nil, natsErrToWit(err)
+	}
+	config := link.config
+	if config.ObjectBucket == "" {
+		return nil, natsErrToWit(nats.ErrStreamNotFound)
+	}
+	js, err := link.nc.JetStream()
+	if err != nil {
+		h.kvHandler.provider.Logger.Error("error getting JetStream context", "error", err)
+		return nil, natsErrToWit(err)
+	}
+	obs, err := js.ObjectStore(config.ObjectBucket)
+	if err != nil {
+		h.kvHandler.provider.Logger.Error("error getting object store", "bucket", config.ObjectBucket, "error", err)
+		return nil, natsErrToWit(err)
+	}
+	if config.KeyPrefix != "" {
+		obs = wrapPrefixedObjectStore(obs, config.KeyPrefix)
+	}
+	return obs, nil
+}
+
+// prefixedObjectStore confines a nats.ObjectStore to the objects named below a prefix, the same way prefixkv confines keys
+// INFO: only what object-store uses is wrapped, other methods reach every object of the bucket
+type prefixedObjectStore struct {
+	nats.ObjectStore
+	prefix string
+}
+
+func wrapPrefixedObjectStore(obs nats.ObjectStore, prefix string) *prefixedObjectStore {
+	if !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &prefixedObjectStore{ObjectStore: obs, prefix: prefix}
+}
+
+func (obs *prefixedObjectStore) info(info *nats.ObjectInfo) *nats.ObjectInfo {
+	stripped := *info
+	stripped.Name = strings.TrimPrefix(info.Name, obs.prefix)
+	return &stripped
+}
+
+func (obs *prefixedObjectStore) Put(meta *nats.ObjectMeta, reader io.Reader, opts ...nats.ObjectOpt) (*nats.ObjectInfo, error) {
+	prefixed := *meta
+	prefixed.Name = obs.prefix + meta.Name
+	info, err := obs.ObjectStore.Put(&prefixed, reader, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return obs.info(info), nil
+}
+
+func (obs *prefixedObjectStore) Get(name string, opts ...nats.GetObjectOpt) (nats.ObjectResult, error) {
+	return obs.ObjectStore.Get(obs.prefix+name, opts...)
+}
+
+func (obs *prefixedObjectStore) Delete(name string) error {
+	return obs.ObjectStore.Delete(obs.prefix + name)
+}
+
+func (obs *prefixedObjectStore) GetInfo(name string, opts ...nats.GetObjectInfoOpt) (*nats.ObjectInfo, error) {
+	info, err := obs.ObjectStore.GetInfo(obs.prefix+name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return obs.info(info), nil
+}
+
+// List still reads the info of every object in the bucket, the names are only filtered afterwards
+func (obs *prefixedObjectStore) List(opts ...nats.ListObjectsOpt) ([]*nats.ObjectInfo, error) {
+	infos, err := obs.ObjectStore.List(opts...)
+	if err != nil {
+		return nil, err
+	}
+	var below []*nats.ObjectInfo
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name, obs.prefix) {
+			below = append(below, obs.info(info))
+		}
+	}
+	if len(below) == 0 {
+		return nil, nats.ErrNoObjectsFound
+	}
+	return below, nil
+}
+
+func toWitObjectInfo(info *nats.ObjectInfo) *object_store.ObjectInfo {
+	return &object_store.ObjectInfo{
+		Name:        info.Name,
+		Description: info.Description,
+		Size:        info.Size,
+		Chunks:      info.Chunks,
+		Digest:      info.Digest,
+		Modified:    uint64(info.ModTime.UnixNano()),
+	}
+}
+
+func (h *ObjectStoreHandler) Put(ctx__ context.Context, name string, data io.ReadCloser) (*wrpc.Result[object_store.ObjectInfo, object_store.Error], error) {
+	defer data.Close()
+	obs, witErr := h.linkedObjectStore(ctx__)
+	if witErr != nil {
+		return wrpc.Err[object_store.ObjectInfo](*witErr), nil
+	}
+	info, err := obs.Put(&nats.ObjectMeta{Name: name}, data)
+	if err != nil {
+		h.kvHandler.provider.Logger.Error("error putting object", "name", name, "error", err)
+		return wrpc.Err[object_store.ObjectInfo](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[object_store.Error](*toWitObjectInfo(info)), nil
+}
+
+// Get streams the object, the chunks are read from JetStream as the component reads the stream
+func (h *ObjectStoreHandler) Get(ctx__ context.Context, name string) (*wrpc.Result[io.ReadCloser, object_store.Error], error) {
+	obs, witErr := h.linkedObjectStore(ctx__)
+	if witErr != nil {
+		return wrpc.Err[io.ReadCloser](*witErr), nil
+	}
+	result, err := obs.Get(name)
+	if err != nil {
+		return wrpc.Err[io.ReadCloser](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[object_store.Error](io.ReadCloser(result)), nil
+}
+
+func (h *ObjectStoreHandler) Delete(ctx__ context.Context, name string) (*wrpc.Result[struct{}, object_store.Error], error) {
+	obs, witErr := h.linkedObjectStore(ctx__)
+	if witErr != nil {
+		return wrpc.Err[struct{}](*witErr), nil
+	}
+	if err := obs.Delete(name); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[object_store.Error](struct{}{}), nil
+}
+
+func (h *ObjectStoreHandler) List(ctx__ context.Context) (*wrpc.Result[[]*object_store.ObjectInfo, object_store.Error], error) {
+	obs, witErr := h.linkedObjectStore(ctx__)
+	if witErr != nil {
+		return wrpc.Err[[]*object_store.ObjectInfo](*witErr), nil
+	}
+	infos, err := obs.List(nats.Context(ctx__))
+	if err != nil && !errors.Is(err, nats.ErrNoObjectsFound) {
+		return wrpc.Err[[]*object_store.ObjectInfo](*natsErrToWit(err)), nil
+	}
+	witInfos := make([]*object_store.ObjectInfo, 0, len(infos))
+	for _, info := range infos {
+		witInfos = append(witInfos, toWitObjectInfo(info))
+	}
+	return wrpc.Ok[object_store.Error](witInfos), nil
+}
+
+func (h *ObjectStoreHandler) Info(ctx__ context.Context, name string) (*wrpc.Result[object_store.ObjectInfo, object_store.Error], error) {
+	obs, witErr := h.linkedObjectStore(ctx__)
+	if witErr != nil {
+		return wrpc.Err[object_store.ObjectInfo](*witErr), nil
+	}
+	info, err := obs.GetInfo(name)
+	if err != nil {
+		return wrpc.Err[object_store.ObjectInfo](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[object_store.Error](*toWitObjectInfo(info)), nil
+}
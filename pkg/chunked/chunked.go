@@ -0,0 +1,312 @@
+package chunked
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// DefaultChunkSize stays well below the default max payload of a nats server
+const DefaultChunkSize = 128 * 1024
+
+// headroom is left in every chunk for what's added on the way to the bucket, e.g. the compression marker or the encryption envelope with its key id, nonce and tag
+const headroom = 1024
+
+// maxRetries bounds how often a write guarded by a revision is retried when the key was written meanwhile
+const maxRetries = 10
+
+var (
+	// ErrReplaced is returned while streaming a value whose chunks were purged because it was replaced or removed meanwhile
+	ErrReplaced   = errors.New("chunked value was replaced while it was read")
+	ErrContention = fmt.Errorf("chunked write gave up after %d attempts due to concurrent writes", maxRetries)
+)
+
+// manifestMarker starts every manifest value, such that Get can tell a manifest from a plain value
+var manifestMarker = []byte("map-nats-kv/chunked\n")
+
+// Manifest is stored under the key, the chunks are stored in a bucket of their own, see chunkKey
+type Manifest struct {
+	ID     string `json:"id"`
+	Chunks int    `json:"chunks"`
+	Size   uint64 `json:"size"`
+}
+
+// INFO: every write gets a new id, such that a reader never sees a mix of chunks from two writes
+func chunkKey(id string, i int) string {
+	return id + "." + strconv.Itoa(i)
+}
+
+// Chunks is the bucket the chunks of a bucket are kept in
+type Chunks interface {
+	// Open returns the bucket, creating it if create is set. It returns nil if the bucket doesn't exist, no value can then be a manifest
+	Open(create bool) (nats.KeyValue, error)
+	// Purge removes every chunk of a manifest at once, see PurgeStream
+	Purge(id string) error
+}
+
+// PurgeStream purges the chunks of a manifest from the stream backing the chunks bucket, which unlike purging key by key leaves no purge markers behind
+// INFO: the chunk keys have to be stored as they are, without a key prefix or encoding
+func PurgeStream(js nats.JetStreamContext, bucket, id string) error {
+	return js.PurgeStream("KV_"+bucket, &nats.StreamPurgeRequest{Subject: "$KV." + bucket + "." + id + ".>"})
+}
+
+// ChunkSize fits a chunk, and what's added to it when it's stored, within the bucket's max value size, if it has one
+func ChunkSize(kv nats.KeyValue) int {
+	status, err := kv.Status()
+	if err != nil {
+		return DefaultChunkSize
+	}
+	bucketStatus, ok := status.(*nats.KeyValueBucketStatus)
+	if !ok {
+		return DefaultChunkSize
+	}
+	if maxMsgSize := int(bucketStatus.StreamInfo().Config.MaxMsgSize); maxMsgSize > 0 && maxMsgSize-headroom < DefaultChunkSize {
+		return max(maxMsgSize-headroom, 1)
+	}
+	return DefaultChunkSize
+}
+
+// KeyValue streams values too large for a single entry through chunks, and keeps the chunks from being left behind by plain writes
+// Put, Update, Delete and Purge look for a manifest they replace only once the chunks bucket exists, until then they cost nothing extra
+// INFO: only a manifest is replaced guarded by the revision it was read at, other values are written as before.
+// A delete or purge of a streamed value the component doesn't guard itself may therefore fail with ErrContention when the key keeps being written
+type KeyValue struct {
+	nats.KeyValue
+	chunks Chunks
+}
+
+func Wrap(kv nats.KeyValue, chunks Chunks) *KeyValue {
+	return &KeyValue{KeyValue: kv, chunks: chunks}
+}
+
+// PutStream writes the chunks first and then the manifest, readers therefore see either the old or the new value
+// The manifest is swapped in guarded by the revision it replaces, the chunks of that value are purged once it's swapped
+// INFO: a GetStream still streaming the replaced value fails with ErrReplaced rather than mixing the two
+func (kv *KeyValue) PutStream(key string, r io.Reader) (uint64, error) {
+	chunks, err := kv.chunks.Open(true)
+	if err != nil {
+		return 0, err
+	}
+	manifest := Manifest{ID: nuid.Next()}
+	buf := make([]byte, ChunkSize(chunks))
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := chunks.Put(chunkKey(manifest.ID, manifest.Chunks), buf[:n]); err != nil {
+				kv.purgeChunks(&manifest)
+				return 0, err
+			}
+			manifest.Chunks++
+			manifest.Size += uint64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			kv.purgeChunks(&manifest)
+			return 0, err
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		kv.purgeChunks(&manifest)
+		return 0, err
+	}
+	value := append(bytes.Clone(manifestMarker), data...)
+	// INFO: a concurrent write makes the swap fail, the value it wrote is then read again and replaced in turn, such that its chunks aren't lost track of
+	for range maxRetries {
+		previous, revision, err := kv.readManifest(key)
+		if err != nil {
+			kv.purgeChunks(&manifest)
+			return 0, err
+		}
+		if revision == 0 {
+			revision, err = kv.KeyValue.Create(key, value)
+		} else {
+			revision, err = kv.KeyValue.Update(key, value, revision)
+		}
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			kv.purgeChunks(&manifest)
+			return 0, err
+		}
+		if previous != nil {
+			kv.purgeChunks(previous)
+		}
+		return revision, nil
+	}
+	kv.purgeChunks(&manifest)
+	return 0, ErrContention
+}
+
+// GetStream streams the value of key, chunk by chunk if it was written by PutStream, or as is if it's a plain value
+func (kv *KeyValue) GetStream(key string) (io.ReadCloser, error) {
+	entry, err := kv.KeyValue.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	manifest, ok := parseManifest(entry.Value())
+	if !ok {
+		return io.NopCloser(bytes.NewReader(entry.Value())), nil
+	}
+	chunks, err := kv.chunks.Open(false)
+	if err != nil {
+		return nil, err
+	}
+	if chunks == nil {
+		return nil, ErrReplaced
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for i := range manifest.Chunks {
+			chunk, err := chunks.Get(chunkKey(manifest.ID, i))
+			if errors.Is(err, nats.ErrKeyNotFound) {
+				err = ErrReplaced
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write(chunk.Value()); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+func (kv *KeyValue) Put(key string, value []byte) (uint64, error) {
+	for range maxRetries {
+		previous, revision, err := kv.replaced(key)
+		if err != nil {
+			return 0, err
+		}
+		if previous == nil {
+			return kv.KeyValue.Put(key, value)
+		}
+		revision, err = kv.KeyValue.Update(key, value, revision)
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		kv.purgeChunks(previous)
+		return revision, nil
+	}
+	return 0, ErrContention
+}
+
+func (kv *KeyValue) PutString(key string, value string) (uint64, error) {
+	return kv.Put(key, []byte(value))
+}
+
+// Update is guarded by last already, the chunks are purged if last was a manifest
+func (kv *KeyValue) Update(key string, value []byte, last uint64) (uint64, error) {
+	previous, read, err := kv.replaced(key)
+	if err != nil {
+		return 0, err
+	}
+	revision, err := kv.KeyValue.Update(key, value, last)
+	if err == nil && previous != nil && read == last {
+		kv.purgeChunks(previous)
+	}
+	return revision, err
+}
+
+func (kv *KeyValue) Delete(key string, opts ...nats.DeleteOpt) error {
+	return kv.remove(key, opts, kv.KeyValue.Delete)
+}
+
+func (kv *KeyValue) Purge(key string, opts ...nats.DeleteOpt) error {
+	return kv.remove(key, opts, kv.KeyValue.Purge)
+}
+
+// remove guards a manifest by the revision it was read at, unless the caller guards it with opts already
+func (kv *KeyValue) remove(key string, opts []nats.DeleteOpt, remove func(string, ...nats.DeleteOpt) error) error {
+	for range maxRetries {
+		previous, revision, err := kv.replaced(key)
+		if err != nil {
+			return err
+		}
+		if previous == nil {
+			return remove(key, opts...)
+		}
+		guarded := opts
+		if len(guarded) == 0 {
+			guarded = []nats.DeleteOpt{nats.LastRevision(revision)}
+		}
+		err = remove(key, guarded...)
+		if errors.Is(err, nats.ErrKeyExists) && len(opts) == 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		kv.purgeChunks(previous)
+		return nil
+	}
+	return ErrContention
+}
+
+// replaced returns the manifest a write to key would replace, and its revision. It doesn't read key until the chunks bucket exists
+// INFO: a value that can't be read, e.g. one that can't be decrypted, is written over as is, it's just not known to hold chunks
+func (kv *KeyValue) replaced(key string) (*Manifest, uint64, error) {
+	chunks, err := kv.chunks.Open(false)
+	if err != nil || chunks == nil {
+		return nil, 0, err
+	}
+	manifest, revision, err := kv.readManifest(key)
+	if err != nil {
+		return nil, 0, nil
+	}
+	return manifest, revision, nil
+}
+
+// readManifest returns the manifest of key, if it holds one, and its revision, 0 when the key doesn't exist
+func (kv *KeyValue) readManifest(key string) (*Manifest, uint64, error) {
+	entry, err := kv.KeyValue.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	manifest, ok := parseManifest(entry.Value())
+	if !ok {
+		return nil, entry.Revision(), nil
+	}
+	return manifest, entry.Revision(), nil
+}
+
+func parseManifest(value []byte) (*Manifest, bool) {
+	data, ok := bytes.CutPrefix(value, manifestMarker)
+	if !ok {
+		return nil, false
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, false
+	}
+	return &manifest, true
+}
+
+// purgeChunks only logs failures, the write the chunks belonged to has gone through already
+func (kv *KeyValue) purgeChunks(manifest *Manifest) {
+	if manifest.Chunks == 0 {
+		return
+	}
+	if err := kv.chunks.Purge(manifest.ID); err != nil {
+		slog.Warn("Failed to purge chunks", "bucket", kv.Bucket(), "id", manifest.ID, "chunks", manifest.Chunks, "error", err)
+	}
+}
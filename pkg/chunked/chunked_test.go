@@ -0,0 +1,249 @@
+package chunked
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+type fakeEntry struct {
+	nats.KeyValueEntry
+	key      string
+	value    []byte
+	revision uint64
+}
+
+func (e *fakeEntry) Key() string      { return e.key }
+func (e *fakeEntry) Value() []byte    { return e.value }
+func (e *fakeEntry) Revision() uint64 { return e.revision }
+
+// fakeKv keeps the latest value per key, removes drop the key, and counts reads and guarded removes
+type fakeKv struct {
+	nats.KeyValue
+	entries  map[string]*fakeEntry
+	revision uint64
+	gets     int
+	guarded  int
+}
+
+func newFakeKv() *fakeKv {
+	return &fakeKv{entries: map[string]*fakeEntry{}}
+}
+
+func (kv *fakeKv) Bucket() string { return "fake" }
+
+func (kv *fakeKv) Status() (nats.KeyValueStatus, error) {
+	return nil, errors.New("no status")
+}
+
+func (kv *fakeKv) Get(key string) (nats.KeyValueEntry, error) {
+	kv.gets++
+	entry, ok := kv.entries[key]
+	if !ok {
+		return nil, nats.ErrKeyNotFound
+	}
+	return entry, nil
+}
+
+func (kv *fakeKv) Put(key string, value []byte) (uint64, error) {
+	kv.revision++
+	kv.entries[key] = &fakeEntry{key: key, value: bytes.Clone(value), revision: kv.revision}
+	return kv.revision, nil
+}
+
+func (kv *fakeKv) Create(key string, value []byte) (uint64, error) {
+	if _, ok := kv.entries[key]; ok {
+		return 0, nats.ErrKeyExists
+	}
+	return kv.Put(key, value)
+}
+
+func (kv *fakeKv) Update(key string, value []byte, last uint64) (uint64, error) {
+	if entry, ok := kv.entries[key]; !ok || entry.revision != last {
+		return 0, nats.ErrKeyExists
+	}
+	return kv.Put(key, value)
+}
+
+func (kv *fakeKv) Delete(key string, opts ...nats.DeleteOpt) error {
+	if len(opts) > 0 {
+		kv.guarded++
+	}
+	delete(kv.entries, key)
+	return nil
+}
+
+func (kv *fakeKv) Purge(key string, opts ...nats.DeleteOpt) error {
+	return kv.Delete(key, opts...)
+}
+
+// fakeChunks purges by id like PurgeStream, the bucket only exists once it's opened with create
+type fakeChunks struct {
+	kv     *fakeKv
+	exists bool
+}
+
+func (c *fakeChunks) Open(create bool) (nats.KeyValue, error) {
+	c.exists = c.exists || create
+	if !c.exists {
+		return nil, nil
+	}
+	return c.kv, nil
+}
+
+func (c *fakeChunks) Purge(id string) error {
+	for key := range c.kv.entries {
+		if strings.HasPrefix(key, id+".") {
+			delete(c.kv.entries, key)
+		}
+	}
+	return nil
+}
+
+func wrap() (*KeyValue, *fakeKv, *fakeChunks) {
+	inner := newFakeKv()
+	chunks := &fakeChunks{kv: newFakeKv()}
+	return Wrap(inner, chunks), inner, chunks
+}
+
+func readAll(t *testing.T, kv *KeyValue, key string) []byte {
+	t.Helper()
+	r, err := kv.GetStream(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestPutGetStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantChunks int
+	}{
+		{"empty", 0, 0},
+		{"one byte", 1, 1},
+		{"one chunk", DefaultChunkSize, 1},
+		{"partial last chunk", DefaultChunkSize*2 + DefaultChunkSize/2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv, _, chunks := wrap()
+			value := bytes.Repeat([]byte("x"), tt.size)
+			if _, err := kv.PutStream("k", bytes.NewReader(value)); err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks.kv.entries) != tt.wantChunks {
+				t.Errorf("PutStream() stored %d chunks, want %d", len(chunks.kv.entries), tt.wantChunks)
+			}
+			if got := readAll(t, kv, "k"); !bytes.Equal(got, value) {
+				t.Errorf("GetStream() returned %d bytes, want %d", len(got), len(value))
+			}
+		})
+	}
+}
+
+func TestGetStreamPlainValue(t *testing.T) {
+	kv, inner, _ := wrap()
+	inner.Put("k", []byte("plain"))
+	if got := readAll(t, kv, "k"); string(got) != "plain" {
+		t.Errorf("GetStream() = %q, want %q", got, "plain")
+	}
+}
+
+func TestGetStreamReplaced(t *testing.T) {
+	kv, _, chunks := wrap()
+	kv.PutStream("k", bytes.NewReader([]byte("streamed")))
+	r, err := kv.GetStream("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks.kv.entries = map[string]*fakeEntry{}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrReplaced) {
+		t.Errorf("GetStream() of purged chunks error = %v, want ErrReplaced", err)
+	}
+}
+
+func TestWritesPurgeReplacedChunks(t *testing.T) {
+	tests := []struct {
+		name        string
+		write       func(kv *KeyValue, revision uint64) error
+		wantGuarded int
+	}{
+		{"put", func(kv *KeyValue, _ uint64) error { _, err := kv.Put("k", []byte("v")); return err }, 0},
+		{"put string", func(kv *KeyValue, _ uint64) error { _, err := kv.PutString("k", "v"); return err }, 0},
+		{"update", func(kv *KeyValue, revision uint64) error { _, err := kv.Update("k", []byte("v"), revision); return err }, 0},
+		{"put stream", func(kv *KeyValue, _ uint64) error { _, err := kv.PutStream("k", strings.NewReader("v")); return err }, 0},
+		{"delete", func(kv *KeyValue, _ uint64) error { return kv.Delete("k") }, 1},
+		{"purge", func(kv *KeyValue, _ uint64) error { return kv.Purge("k") }, 1},
+		{"guarded delete", func(kv *KeyValue, revision uint64) error { return kv.Delete("k", nats.LastRevision(revision)) }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv, inner, chunks := wrap()
+			revision, err := kv.PutStream("k", bytes.NewReader(bytes.Repeat([]byte("x"), DefaultChunkSize+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.write(kv, revision); err != nil {
+				t.Fatal(err)
+			}
+			for key := range chunks.kv.entries {
+				if manifest, _, _ := kv.readManifest("k"); manifest == nil || !strings.HasPrefix(key, manifest.ID+".") {
+					t.Errorf("chunk %q was left behind", key)
+				}
+			}
+			if inner.guarded != tt.wantGuarded {
+				t.Errorf("guarded removes = %d, want %d", inner.guarded, tt.wantGuarded)
+			}
+		})
+	}
+}
+
+func TestWritesWithoutChunksBucket(t *testing.T) {
+	kv, inner, chunks := wrap()
+	if _, err := kv.Put("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if inner.gets != 0 || inner.guarded != 0 || chunks.exists {
+		t.Errorf("writes without a chunks bucket read %d times, guarded %d removes and created it: %v", inner.gets, inner.guarded, chunks.exists)
+	}
+}
+
+func TestPutStreamContention(t *testing.T) {
+	kv, _, chunks := wrap()
+	kv.KeyValue = &contendedKv{fakeKv: newFakeKv()}
+	if _, err := kv.PutStream("k", strings.NewReader("v")); !errors.Is(err, ErrContention) {
+		t.Errorf("PutStream() error = %v, want ErrContention", err)
+	}
+	if len(chunks.kv.entries) != 0 {
+		t.Errorf("PutStream() left %d chunks behind after giving up", len(chunks.kv.entries))
+	}
+}
+
+// contendedKv is written by someone else between every read and write
+type contendedKv struct {
+	*fakeKv
+}
+
+func (kv *contendedKv) Get(key string) (nats.KeyValueEntry, error) {
+	kv.fakeKv.Put(key, []byte("other"))
+	return kv.fakeKv.Get(key)
+}
+
+func (kv *contendedKv) Update(key string, value []byte, last uint64) (uint64, error) {
+	kv.fakeKv.Put(key, []byte("other"))
+	return kv.fakeKv.Update(key, value, last)
+}
@@ -0,0 +1,214 @@
+package compressedkv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/Mattilsynet/map-nats-kv/pkg/kvwrap"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	S2   = "s2"
+	Zstd = "zstd"
+)
+
+// marker precedes every compressed value, followed by one byte naming the algorithm
+// INFO: values without the marker are returned as they are, such that values written before compression was enabled stay readable
+var marker = []byte("\x00mkz")
+
+const (
+	algS2   byte = 's'
+	algZstd byte = 'z'
+)
+
+// maxDecodedSize bounds the memory a single value may decompress into, such that a small crafted value can't exhaust the provider
+const maxDecodedSize = 64 << 20
+
+var ErrTooLarge = fmt.Errorf("compressed value decodes to more than %d bytes", maxDecodedSize)
+
+// INFO: EncodeAll and DecodeAll are safe for concurrent use, so one encoder and decoder is shared by every bucket
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+	})
+)
+
+// Algorithm returns the marker byte of a value_compression link setting
+func Algorithm(name string) (byte, error) {
+	switch name {
+	case S2:
+		return algS2, nil
+	case Zstd:
+		return algZstd, nil
+	default:
+		return 0, fmt.Errorf("unknown value compression %q, expected %q or %q", name, S2, Zstd)
+	}
+}
+
+// Compress only keeps the compressed value when it's smaller, values that don't compress are stored as they are
+func Compress(alg byte, value []byte) ([]byte, error) {
+	var compressed []byte
+	switch alg {
+	case algS2:
+		compressed = s2.Encode(nil, value)
+	case algZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		compressed = encoder.EncodeAll(value, nil)
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", alg)
+	}
+	// a plain value starting with the marker would be mistaken for a compressed one, so it's always compressed
+	if len(marker)+1+len(compressed) >= len(value) && !bytes.HasPrefix(value, marker) {
+		return value, nil
+	}
+	out := make([]byte, 0, len(marker)+1+len(compressed))
+	out = append(out, marker...)
+	out = append(out, alg)
+	return append(out, compressed...), nil
+}
+
+// Decompress decompresses with whatever algorithm the value was written with, not the one configured on the link
+func Decompress(value []byte) ([]byte, error) {
+	if len(value) <= len(marker) || !bytes.HasPrefix(value, marker) {
+		return value, nil
+	}
+	compressed := value[len(marker)+1:]
+	switch value[len(marker)] {
+	case algS2:
+		size, err := s2.DecodedLen(compressed)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxDecodedSize {
+			return nil, ErrTooLarge
+		}
+		return s2.Decode(nil, compressed)
+	case algZstd:
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := decoder.DecodeAll(compressed, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, ErrTooLarge
+		}
+		return decoded, err
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", value[len(marker)])
+	}
+}
+
+// KeyValue compresses values going in and decompresses them coming out
+type KeyValue struct {
+	nats.KeyValue
+	alg byte
+}
+
+func Wrap(kv nats.KeyValue, alg byte) *KeyValue {
+	return &KeyValue{KeyValue: kv, alg: alg}
+}
+
+// entry decompresses up front, as Value can't return an error
+func (kv *KeyValue) entry(entry nats.KeyValueEntry) (nats.KeyValueEntry, error) {
+	if entry == nil {
+		return nil, nil
+	}
+	value, err := Decompress(entry.Value())
+	if err != nil {
+		return nil, err
+	}
+	return kvwrap.WithValue(entry, value), nil
+}
+
+func (kv *KeyValue) Get(key string) (nats.KeyValueEntry, error) {
+	entry, err := kv.KeyValue.Get(key)
+	if err != nil {
+		return entry, err
+	}
+	return kv.entry(entry)
+}
+
+func (kv *KeyValue) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	entry, err := kv.KeyValue.GetRevision(key, revision)
+	if err != nil {
+		return entry, err
+	}
+	return kv.entry(entry)
+}
+
+func (kv *KeyValue) Put(key string, value []byte) (uint64, error) {
+	compressed, err := Compress(kv.alg, value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.KeyValue.Put(key, compressed)
+}
+
+func (kv *KeyValue) PutString(key string, value string) (uint64, error) {
+	return kv.Put(key, []byte(value))
+}
+
+func (kv *KeyValue) Create(key string, value []byte) (uint64, error) {
+	compressed, err := Compress(kv.alg, value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.KeyValue.Create(key, compressed)
+}
+
+func (kv *KeyValue) Update(key string, value []byte, last uint64) (uint64, error) {
+	compressed, err := Compress(kv.alg, value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.KeyValue.Update(key, compressed, last)
+}
+
+func (kv *KeyValue) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	entries, err := kv.KeyValue.History(key, opts...)
+	if err != nil {
+		return entries, err
+	}
+	for i, entry := range entries {
+		if entries[i], err = kv.entry(entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (kv *KeyValue) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.WatchFiltered([]string{keys}, opts...)
+}
+
+func (kv *KeyValue) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.WatchFiltered([]string{nats.AllKeys}, opts...)
+}
+
+func (kv *KeyValue) WatchFiltered(keys []string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := kv.KeyValue.WatchFiltered(keys, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return kvwrap.MapWatcher(watcher, kv.watchEntry), nil
+}
+
+// watchEntry drops entries that can't be decompressed, rather than delivering compressed bytes or passing them off as an empty value
+func (kv *KeyValue) watchEntry(entry nats.KeyValueEntry) nats.KeyValueEntry {
+	decompressed, err := kv.entry(entry)
+	if err != nil {
+		slog.Error("Dropping watch update that can't be decompressed", "bucket", entry.Bucket(), "key", entry.Key(), "revision", entry.Revision(), "error", err)
+		return nil
+	}
+	return decompressed
+}
@@ -0,0 +1,94 @@
+package compressedkv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestAlgorithm(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    byte
+		wantErr bool
+	}{
+		{S2, algS2, false},
+		{Zstd, algZstd, false},
+		{"gzip", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := Algorithm(tt.name)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("Algorithm(%q) = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCompressDecompress(t *testing.T) {
+	values := []struct {
+		name       string
+		value      []byte
+		compressed bool
+	}{
+		{"empty", nil, false},
+		{"short", []byte("hi"), false},
+		{"incompressible", []byte("q8Zx2#kL"), false},
+		{"repetitive", bytes.Repeat([]byte("orders "), 1000), true},
+		{"starts with the marker", append(bytes.Clone(marker), 'x'), true},
+	}
+	for _, name := range []string{S2, Zstd} {
+		alg, _ := Algorithm(name)
+		for _, tt := range values {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				stored, err := Compress(alg, tt.value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := bytes.HasPrefix(stored, marker); got != tt.compressed {
+					t.Errorf("Compress() stored with marker = %v, want %v", got, tt.compressed)
+				}
+				if tt.compressed && stored[len(marker)] != alg {
+					t.Errorf("Compress() algorithm byte = %q, want %q", stored[len(marker)], alg)
+				}
+				value, err := Decompress(stored)
+				if err != nil || !bytes.Equal(value, tt.value) {
+					t.Errorf("Decompress(Compress(%q)) = %q, %v", tt.value, value, err)
+				}
+			})
+		}
+	}
+}
+
+func TestDecompressRejects(t *testing.T) {
+	s2Bomb, _ := Compress(algS2, make([]byte, maxDecodedSize+1))
+	zstdBomb, _ := Compress(algZstd, make([]byte, maxDecodedSize+1))
+	tests := []struct {
+		name  string
+		value []byte
+		want  error
+	}{
+		{"unknown algorithm", append(bytes.Clone(marker), 'x', 1, 2, 3), nil},
+		{"corrupt s2", append(bytes.Clone(marker), algS2, 0xff, 0xff, 0xff), nil},
+		{"corrupt zstd", append(bytes.Clone(marker), algZstd, 0xff, 0xff, 0xff), nil},
+		{"s2 too large", s2Bomb, ErrTooLarge},
+		{"zstd too large", zstdBomb, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decompress(tt.value)
+			if err == nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Decompress() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecompressPassesPlainValues(t *testing.T) {
+	for _, value := range [][]byte{nil, []byte("plain"), marker} {
+		got, err := Decompress(value)
+		if err != nil || !bytes.Equal(got, value) {
+			t.Errorf("Decompress(%q) = %q, %v, want it as is", value, got, err)
+		}
+	}
+}
@@ -1,13 +1,45 @@
 package config
 
-import "strconv"
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrWatchHistoryUpdatesOnly = errors.New("watch_include_history and watch_updates_only can not be combined")
 
 type Config struct {
 	NatsURL string
 	Bucket  string
+	// INFO: logical store name to bucket, e.g. "sessions=prod-sessions,config=prod-config"
+	Buckets map[string]string
+	// INFO: every key is stored below this prefix, such that several components can share one bucket
+	KeyPrefix string
+	// INFO: "base64url" or "path-segment", lets components use keys with characters NATS doesn't allow, e.g. URLs or "æøå"
+	KeyEncoding string
+	// INFO: "s2" or "zstd", values are compressed before they're written and decompressed when read
+	ValueCompression string
+	// INFO: with data encryption keys, values that aren't encrypted are rejected unless this is set, e.g. while migrating a bucket written before encryption was enabled
+	AllowPlaintextValues bool
+	// INFO: key pattern to the key of a json schema in SchemaBucket, e.g. "orders.>=orders,config.*=config", writes to matching keys are validated
+	Schemas      map[string]string
+	SchemaBucket string
+	// INFO: object store bucket used by object-store
+	ObjectBucket string
+	// INFO: bucket used by lock and election, defaults to a provider owned "<Bucket>-leases"
+	LockBucket string
 	// INFO: we need to wait a little for the component to startup such that we don't aggregate the kv watchall data to the component before it's deployment time, if we do this we're in a stall and nothing happens during watchall
 	ComponentEstimatedStartupTime int
-	ProviderConfig                map[string]string
+	// INFO: key patterns to watch, delivered through watch instead of watch-all, e.g. "orders.>,config.*"
+	WatchKeys []string
+	// INFO: watch options, include history and updates only can not be combined
+	WatchIncludeHistory bool
+	WatchIgnoreDeletes  bool
+	WatchUpdatesOnly    bool
+	WatchMetaOnly       bool
+	// INFO: provider owned bucket keeping the last delivered revision per watch, resuming is disabled when empty
+	WatchStateBucket string
+	ProviderConfig   map[string]string
 }
 
 func From(config map[string]string) *Config {
@@ -18,7 +50,69 @@ func From(config map[string]string) *Config {
 	return &Config{
 		NatsURL:                       config["url"],
 		Bucket:                        config["bucket"],
+		Buckets:                       splitMapping(config["buckets"]),
+		Schemas:                       splitMapping(config["schemas"]),
+		SchemaBucket:                  config["schema_bucket"],
+		ObjectBucket:                  config["object_bucket"],
+		LockBucket:                    config["lock_bucket"],
+		KeyPrefix:                     config["key_prefix"],
+		KeyEncoding:                   config["key_encoding"],
+		ValueCompression:              config["value_compression"],
+		AllowPlaintextValues:          parseBool(config["allow_plaintext_values"]),
 		ComponentEstimatedStartupTime: componentEstimatedStartupTime,
+		WatchKeys:                     splitList(config["watch_keys"]),
+		WatchIncludeHistory:           parseBool(config["watch_include_history"]),
+		WatchIgnoreDeletes:            parseBool(config["watch_ignore_deletes"]),
+		WatchUpdatesOnly:              parseBool(config["watch_updates_only"]),
+		WatchMetaOnly:                 parseBool(config["watch_meta_only"]),
+		WatchStateBucket:              config["watch_state_bucket"],
 		ProviderConfig:                config,
 	}
 }
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseBool(value string) bool {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false
+	}
+	return b
+}
+
+func splitMapping(value string) map[string]string {
+	mapping := make(map[string]string)
+	for _, item := range splitList(value) {
+		name, bucket, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		mapping[strings.TrimSpace(name)] = strings.TrimSpace(bucket)
+	}
+	return mapping
+}
+
+// ValidateWatch rejects watch settings nats would only refuse once the watch is started
+func (c *Config) ValidateWatch() error {
+	if c.WatchIncludeHistory && c.WatchUpdatesOnly {
+		return ErrWatchHistoryUpdatesOnly
+	}
+	return nil
+}
+
+// BucketFor resolves a logical store name to a bucket, the empty name and the name of the default bucket itself is the default bucket
+func (c *Config) BucketFor(store string) (string, bool) {
+	if store == "" || store == c.Bucket {
+		return c.Bucket, c.Bucket != ""
+	}
+	bucket, ok := c.Buckets[store]
+	return bucket, ok
+}
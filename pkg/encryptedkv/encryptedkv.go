@@ -0,0 +1,205 @@
+package encryptedkv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/Mattilsynet/map-nats-kv/pkg/kvwrap"
+	"github.com/nats-io/nats.go"
+)
+
+// marker precedes every encrypted value, followed by the length of the key id, the key id, the nonce and the sealed value
+var marker = []byte("\x00mke")
+
+var (
+	ErrUnknownKey = errors.New("value is encrypted with an unknown data encryption key")
+	ErrMalformed  = errors.New("malformed encrypted value")
+	ErrPlaintext  = errors.New("value is not encrypted")
+)
+
+// Keyring holds the data encryption keys of a link, values are encrypted with the active key and decrypted with whichever key they name
+// INFO: to rotate, add a new key as the active one and keep the old ones until every value has been rewritten
+type Keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+// NewKeyring takes AES keys of 16, 24 or 32 bytes, keyed by their id
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active data encryption key %q is missing", active)
+	}
+	kr := &Keyring{active: active, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, fmt.Errorf("data encryption key id %q must be 1 to 255 bytes", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("data encryption key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("data encryption key %q: %w", id, err)
+		}
+		kr.aeads[id] = aead
+	}
+	return kr, nil
+}
+
+// Seal encrypts with the active key, the stored key is authenticated such that a value can't be moved to another key
+func (kr *Keyring) Seal(key string, value []byte) ([]byte, error) {
+	aead := kr.aeads[kr.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(marker)+1+len(kr.active)+len(nonce)+len(value)+aead.Overhead())
+	out = append(out, marker...)
+	out = append(out, byte(len(kr.active)))
+	out = append(out, kr.active...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, value, []byte(key)), nil
+}
+
+// Open fails with ErrPlaintext for values without the marker, anyone able to write to the bucket can write those
+func (kr *Keyring) Open(key string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, marker) {
+		return nil, ErrPlaintext
+	}
+	rest := value[len(marker):]
+	if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+		return nil, ErrMalformed
+	}
+	id := string(rest[1 : 1+rest[0]])
+	rest = rest[1+rest[0]:]
+	aead, ok := kr.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(key))
+}
+
+// KeyValue encrypts values going in and decrypts them coming out
+// INFO: wrap the bucket itself, such that the key that is authenticated is the key as stored
+type KeyValue struct {
+	nats.KeyValue
+	keyring   *Keyring
+	plaintext bool
+}
+
+// Wrap rejects values that aren't encrypted, unless plaintext is set
+// INFO: plaintext is meant for migrating a bucket written before encryption was enabled, values without the marker are then returned as they are
+func Wrap(kv nats.KeyValue, keyring *Keyring, plaintext bool) *KeyValue {
+	return &KeyValue{KeyValue: kv, keyring: keyring, plaintext: plaintext}
+}
+
+// entry decrypts put entries, delete and purge markers have no value to decrypt
+func (kv *KeyValue) entry(entry nats.KeyValueEntry) (nats.KeyValueEntry, error) {
+	if entry == nil || entry.Operation() != nats.KeyValuePut {
+		return entry, nil
+	}
+	value, err := kv.keyring.Open(entry.Key(), entry.Value())
+	if errors.Is(err, ErrPlaintext) && kv.plaintext {
+		return entry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kvwrap.WithValue(entry, value), nil
+}
+
+func (kv *KeyValue) Get(key string) (nats.KeyValueEntry, error) {
+	entry, err := kv.KeyValue.Get(key)
+	if err != nil {
+		return entry, err
+	}
+	return kv.entry(entry)
+}
+
+func (kv *KeyValue) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	entry, err := kv.KeyValue.GetRevision(key, revision)
+	if err != nil {
+		return entry, err
+	}
+	return kv.entry(entry)
+}
+
+func (kv *KeyValue) Put(key string, value []byte) (uint64, error) {
+	sealed, err := kv.keyring.Seal(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.KeyValue.Put(key, sealed)
+}
+
+func (kv *KeyValue) PutString(key string, value string) (uint64, error) {
+	return kv.Put(key, []byte(value))
+}
+
+func (kv *KeyValue) Create(key string, value []byte) (uint64, error) {
+	sealed, err := kv.keyring.Seal(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.KeyValue.Create(key, sealed)
+}
+
+func (kv *KeyValue) Update(key string, value []byte, last uint64) (uint64, error) {
+	sealed, err := kv.keyring.Seal(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.KeyValue.Update(key, sealed, last)
+}
+
+func (kv *KeyValue) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	entries, err := kv.KeyValue.History(key, opts...)
+	if err != nil {
+		return entries, err
+	}
+	for i, entry := range entries {
+		if entries[i], err = kv.entry(entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (kv *KeyValue) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.WatchFiltered([]string{keys}, opts...)
+}
+
+func (kv *KeyValue) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.WatchFiltered([]string{nats.AllKeys}, opts...)
+}
+
+func (kv *KeyValue) WatchFiltered(keys []string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := kv.KeyValue.WatchFiltered(keys, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return kvwrap.MapWatcher(watcher, kv.watchEntry), nil
+}
+
+// watchEntry drops entries that can't be decrypted, rather than delivering ciphertext or passing them off as an empty value
+// INFO: entries without a value are passed on as they are, that's what a meta only watch delivers, a sealed value is never empty
+func (kv *KeyValue) watchEntry(entry nats.KeyValueEntry) nats.KeyValueEntry {
+	if len(entry.Value()) == 0 {
+		return entry
+	}
+	decrypted, err := kv.entry(entry)
+	if err != nil {
+		slog.Error("Dropping watch update that can't be decrypted", "bucket", entry.Bucket(), "key", entry.Key(), "revision", entry.Revision(), "error", err)
+		return nil
+	}
+	return decrypted
+}
@@ -0,0 +1,156 @@
+package encryptedkv
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func keyring(t *testing.T, active string, keys map[string][]byte) *Keyring {
+	t.Helper()
+	kr, err := NewKeyring(active, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		active  string
+		keys    map[string][]byte
+		wantErr bool
+	}{
+		{"one key", "k1", map[string][]byte{"k1": key1}, false},
+		{"rotated", "k2", map[string][]byte{"k1": key1, "k2": key2}, false},
+		{"active missing", "k3", map[string][]byte{"k1": key1}, true},
+		{"bad key length", "k1", map[string][]byte{"k1": []byte("short")}, true},
+		{"empty id", "", map[string][]byte{"": key1}, true},
+		{"id too long", string(bytes.Repeat([]byte("x"), 256)), map[string][]byte{string(bytes.Repeat([]byte("x"), 256)): key1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyring(tt.active, tt.keys); (err != nil) != tt.wantErr {
+				t.Errorf("NewKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	kr := keyring(t, "k1", map[string][]byte{"k1": key1})
+	for _, value := range [][]byte{{}, []byte("hello"), bytes.Repeat([]byte("x"), 1<<16), marker} {
+		sealed, err := kr.Seal("orders.1", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(sealed, marker) || len(value) > 0 && bytes.Contains(sealed[len(marker):], value) {
+			t.Errorf("Seal(%q) = %q, want the marker followed by ciphertext", value, sealed)
+		}
+		opened, err := kr.Open("orders.1", sealed)
+		if err != nil || !bytes.Equal(opened, value) {
+			t.Errorf("Open(Seal(%q)) = %q, %v", value, opened, err)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old := keyring(t, "k1", map[string][]byte{"k1": key1})
+	rotated := keyring(t, "k2", map[string][]byte{"k1": key1, "k2": key2})
+	sealedOld, _ := old.Seal("k", []byte("old"))
+	sealedNew, _ := rotated.Seal("k", []byte("new"))
+	if opened, err := rotated.Open("k", sealedOld); err != nil || string(opened) != "old" {
+		t.Errorf("values sealed with a retired key must stay readable, got %q, %v", opened, err)
+	}
+	if _, err := old.Open("k", sealedNew); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Open with a keyring missing the key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	kr := keyring(t, "k1", map[string][]byte{"k1": key1})
+	sealed, _ := kr.Seal("orders.1", []byte("hello"))
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+		want  error
+	}{
+		{"plaintext", "orders.1", []byte("hello"), ErrPlaintext},
+		{"empty", "orders.1", nil, ErrPlaintext},
+		{"marker only", "orders.1", marker, ErrMalformed},
+		{"key id longer than the value", "orders.1", append(bytes.Clone(marker), 10, 'k'), ErrMalformed},
+		{"missing nonce", "orders.1", append(bytes.Clone(marker), 2, 'k', '1', 0), ErrMalformed},
+		{"unknown key id", "orders.1", append(bytes.Clone(marker), 2, 'k', '9'), ErrUnknownKey},
+		{"moved to another key", "orders.2", sealed, nil},
+		{"tampered", "orders.1", tampered, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := kr.Open(tt.key, tt.value)
+			if err == nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Open() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+type fakeEntry struct {
+	nats.KeyValueEntry
+	key   string
+	value []byte
+	op    nats.KeyValueOp
+}
+
+func (e *fakeEntry) Key() string                { return e.key }
+func (e *fakeEntry) Value() []byte              { return e.value }
+func (e *fakeEntry) Operation() nats.KeyValueOp { return e.op }
+
+type fakeKv struct {
+	nats.KeyValue
+	history []nats.KeyValueEntry
+}
+
+func (kv *fakeKv) History(string, ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	return slices.Clone(kv.history), nil
+}
+
+func TestHistoryWithDeleteMarkers(t *testing.T) {
+	kr := keyring(t, "k1", map[string][]byte{"k1": key1})
+	sealed, _ := kr.Seal("k", []byte("v1"))
+	inner := &fakeKv{history: []nats.KeyValueEntry{
+		&fakeEntry{key: "k", value: sealed, op: nats.KeyValuePut},
+		&fakeEntry{key: "k", op: nats.KeyValueDelete},
+		&fakeEntry{key: "k", op: nats.KeyValuePurge},
+	}}
+	entries, err := Wrap(inner, kr, false).History("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entries[0].Value()) != "v1" || len(entries[1].Value()) != 0 || entries[2].Operation() != nats.KeyValuePurge {
+		t.Errorf("History() = %q, %q, %v", entries[0].Value(), entries[1].Value(), entries[2].Operation())
+	}
+}
+
+func TestPlaintextValues(t *testing.T) {
+	kr := keyring(t, "k1", map[string][]byte{"k1": key1})
+	inner := &fakeKv{history: []nats.KeyValueEntry{&fakeEntry{key: "k", value: []byte("legacy"), op: nats.KeyValuePut}}}
+	if _, err := Wrap(inner, kr, false).History("k"); !errors.Is(err, ErrPlaintext) {
+		t.Errorf("History() error = %v, want ErrPlaintext", err)
+	}
+	entries, err := Wrap(inner, kr, true).History("k")
+	if err != nil || string(entries[0].Value()) != "legacy" {
+		t.Errorf("History() with plaintext allowed = %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,265 @@
+package keycodec
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Mattilsynet/map-nats-kv/pkg/kvwrap"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	Base64URL   = "base64url"
+	PathSegment = "path-segment"
+)
+
+// emptyToken stands in for an empty token, e.g. the one after the trailing "." of "a.", as NATS keys can't have empty tokens
+// INFO: a lone "=" is never produced by encoding a non empty token, in path-segment "=" is always followed by two hex digits and base64url tokens are "=" followed by at least two characters
+const emptyToken = "="
+
+var ErrMalformed = errors.New("malformed encoded key")
+
+// Codec encodes a single "." separated token of a key, the "." itself is kept such that keys stay hierarchical and wildcards keep working
+type Codec interface {
+	EncodeToken(token string) string
+	DecodeToken(token string) (string, error)
+}
+
+// For returns the codec of a key_encoding link setting
+func For(name string) (Codec, error) {
+	switch name {
+	case Base64URL:
+		return base64Codec{}, nil
+	case PathSegment:
+		return pathSegmentCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown key encoding %q, expected %q or %q", name, Base64URL, PathSegment)
+	}
+}
+
+// Encode encodes every token of the key, including tokens that look like wildcards
+func Encode(codec Codec, key string) string {
+	tokens := strings.Split(key, ".")
+	for i, token := range tokens {
+		tokens[i] = encodeToken(codec, token)
+	}
+	return strings.Join(tokens, ".")
+}
+
+// EncodePattern encodes a key pattern, "*" and ">" tokens are left as they are such that the server still does the filtering
+// INFO: wildcards only work on whole tokens, e.g. "orders.*" but not "ord*"
+func EncodePattern(codec Codec, pattern string) string {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		if token == "*" || token == ">" {
+			continue
+		}
+		tokens[i] = encodeToken(codec, token)
+	}
+	return strings.Join(tokens, ".")
+}
+
+// Decode fails with ErrMalformed unless the key is exactly what Encode makes of the decoded key, such that keys that weren't written through the codec are never mistaken for encoded ones
+func Decode(codec Codec, key string) (string, error) {
+	tokens := strings.Split(key, ".")
+	for i, token := range tokens {
+		if token == emptyToken {
+			tokens[i] = ""
+			continue
+		}
+		decoded, err := codec.DecodeToken(token)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q", ErrMalformed, key)
+		}
+		tokens[i] = decoded
+	}
+	decoded := strings.Join(tokens, ".")
+	if Encode(codec, decoded) != key {
+		return "", fmt.Errorf("%w: %q", ErrMalformed, key)
+	}
+	return decoded, nil
+}
+
+func encodeToken(codec Codec, token string) string {
+	if token == "" {
+		return emptyToken
+	}
+	return codec.EncodeToken(token)
+}
+
+// base64Codec makes any token a valid NATS token, at the cost of readable keys
+// INFO: encoded tokens start with "=", which is outside the base64url alphabet, as plain tokens like "orders" are valid base64url themselves
+type base64Codec struct{}
+
+func (base64Codec) EncodeToken(token string) string {
+	return "=" + base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+func (base64Codec) DecodeToken(token string) (string, error) {
+	encoded, ok := strings.CutPrefix(token, "=")
+	if !ok {
+		return "", ErrMalformed
+	}
+	decoded, err := base64.RawURLEncoding.Strict().DecodeString(encoded)
+	return string(decoded), err
+}
+
+// pathSegmentCodec keeps keys readable by only escaping the bytes NATS doesn't allow, as "=" followed by two hex digits, e.g. "blåbær" becomes "bl=C3=A5b=C3=A6r"
+type pathSegmentCodec struct{}
+
+const hexDigits = "0123456789ABCDEF"
+
+func (pathSegmentCodec) EncodeToken(token string) string {
+	var b strings.Builder
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		if isSafe(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('=')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&0x0f])
+	}
+	return b.String()
+}
+
+func (pathSegmentCodec) DecodeToken(token string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		if c != '=' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(token) {
+			return "", ErrMalformed
+		}
+		hi, lo := strings.IndexByte(hexDigits, token[i+1]), strings.IndexByte(hexDigits, token[i+2])
+		if hi < 0 || lo < 0 {
+			return "", ErrMalformed
+		}
+		b.WriteByte(byte(hi<<4 | lo))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func isSafe(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '/'
+}
+
+// KeyValue encodes keys going in and decodes them coming out, such that components can use keys NATS doesn't allow
+// INFO: keys that can't be decoded, e.g. written before the encoding was enabled, are listed and watched as they are. With path-segment plain keys are their own encoding,
+// with base64url they can't be reached through the codec, so base64url is meant for buckets that start out empty
+type KeyValue struct {
+	nats.KeyValue
+	codec Codec
+}
+
+func Wrap(kv nats.KeyValue, codec Codec) *KeyValue {
+	return &KeyValue{KeyValue: kv, codec: codec}
+}
+
+func (kv *KeyValue) key(key string) string {
+	return Encode(kv.codec, key)
+}
+
+func (kv *KeyValue) decode(key string) string {
+	decoded, err := Decode(kv.codec, key)
+	if err != nil {
+		return key
+	}
+	return decoded
+}
+
+func (kv *KeyValue) entry(entry nats.KeyValueEntry) nats.KeyValueEntry {
+	if entry == nil {
+		return nil
+	}
+	return kvwrap.WithKey(entry, kv.decode(entry.Key()))
+}
+
+func (kv *KeyValue) Get(key string) (nats.KeyValueEntry, error) {
+	entry, err := kv.KeyValue.Get(kv.key(key))
+	return kv.entry(entry), err
+}
+
+func (kv *KeyValue) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	entry, err := kv.KeyValue.GetRevision(kv.key(key), revision)
+	return kv.entry(entry), err
+}
+
+func (kv *KeyValue) Put(key string, value []byte) (uint64, error) {
+	return kv.KeyValue.Put(kv.key(key), value)
+}
+
+func (kv *KeyValue) PutString(key string, value string) (uint64, error) {
+	return kv.KeyValue.PutString(kv.key(key), value)
+}
+
+func (kv *KeyValue) Create(key string, value []byte) (uint64, error) {
+	return kv.KeyValue.Create(kv.key(key), value)
+}
+
+func (kv *KeyValue) Update(key string, value []byte, last uint64) (uint64, error) {
+	return kv.KeyValue.Update(kv.key(key), value, last)
+}
+
+func (kv *KeyValue) Delete(key string, opts ...nats.DeleteOpt) error {
+	return kv.KeyValue.Delete(kv.key(key), opts...)
+}
+
+func (kv *KeyValue) Purge(key string, opts ...nats.DeleteOpt) error {
+	return kv.KeyValue.Purge(kv.key(key), opts...)
+}
+
+func (kv *KeyValue) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	entries, err := kv.KeyValue.History(kv.key(key), opts...)
+	for i, entry := range entries {
+		entries[i] = kv.entry(entry)
+	}
+	return entries, err
+}
+
+func (kv *KeyValue) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.WatchFiltered([]string{keys}, opts...)
+}
+
+func (kv *KeyValue) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.WatchFiltered([]string{nats.AllKeys}, opts...)
+}
+
+func (kv *KeyValue) WatchFiltered(keys []string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	if len(keys) == 0 {
+		keys = []string{nats.AllKeys}
+	}
+	patterns := make([]string, len(keys))
+	for i, key := range keys {
+		patterns[i] = EncodePattern(kv.codec, key)
+	}
+	watcher, err := kv.KeyValue.WatchFiltered(patterns, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return kvwrap.MapWatcher(watcher, kv.entry), nil
+}
+
+func (kv *KeyValue) Keys(opts ...nats.WatchOpt) ([]string, error) {
+	keys, err := kv.KeyValue.Keys(opts...)
+	for i, key := range keys {
+		keys[i] = kv.decode(key)
+	}
+	return keys, err
+}
+
+func (kv *KeyValue) ListKeys(opts ...nats.WatchOpt) (nats.KeyLister, error) {
+	opts = append(opts, nats.IgnoreDeletes(), nats.MetaOnly())
+	watcher, err := kv.WatchAll(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return kvwrap.WatcherLister(watcher), nil
+}
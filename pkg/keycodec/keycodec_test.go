@@ -0,0 +1,120 @@
+package keycodec
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	keys := []string{
+		"orders",
+		"orders.1",
+		"https://www.mattilsynet.no/mat?x=1",
+		"post@mattilsynet.no",
+		"Blåbær og Ærlig Øl AS",
+		"a..b.",
+		".",
+		"*",
+		"orders.>",
+		"=",
+		"=41",
+	}
+	for _, name := range []string{Base64URL, PathSegment} {
+		codec, err := For(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			encoded := Encode(codec, key)
+			decoded, err := Decode(codec, encoded)
+			if err != nil {
+				t.Errorf("%s: Decode(%q) of %q: %v", name, encoded, key, err)
+				continue
+			}
+			if decoded != key {
+				t.Errorf("%s: %q encoded as %q decodes to %q", name, key, encoded, decoded)
+			}
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		codec string
+		key   string
+		want  string
+	}{
+		{Base64URL, "orders", "=b3JkZXJz"},
+		{Base64URL, "a..b", "=YQ.=.=Yg"},
+		{Base64URL, "*", "=Kg"},
+		{PathSegment, "orders.1", "orders.1"},
+		{PathSegment, "Blåbær AS", "Bl=C3=A5b=C3=A6r=20AS"},
+		{PathSegment, "https://x.no/a?b=c", "https=3A//x.no/a=3Fb=3Dc"},
+		{PathSegment, "a.", "a.="},
+		{PathSegment, "*", "=2A"},
+	}
+	for _, tt := range tests {
+		codec, _ := For(tt.codec)
+		if got := Encode(codec, tt.key); got != tt.want {
+			t.Errorf("%s: Encode(%q) = %q, want %q", tt.codec, tt.key, got, tt.want)
+		}
+	}
+}
+
+// keys written before the encoding was enabled must never decode into something else
+func TestDecodeRejectsPlainKeys(t *testing.T) {
+	tests := []struct {
+		codec string
+		key   string
+	}{
+		{Base64URL, "orders"},
+		{Base64URL, "config"},
+		{Base64URL, "orders.=MQ"},
+		{Base64URL, "=b3JkZXJzx"},
+		{PathSegment, "a=41"},
+		{PathSegment, "a=4"},
+		{PathSegment, "a=ZZ"},
+		{PathSegment, "a=3d"},
+	}
+	for _, tt := range tests {
+		codec, _ := For(tt.codec)
+		if decoded, err := Decode(codec, tt.key); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: Decode(%q) = %q, %v, want ErrMalformed", tt.codec, tt.key, decoded, err)
+		}
+	}
+}
+
+func TestDecodeKeepsPlainPathSegmentKeys(t *testing.T) {
+	codec, _ := For(PathSegment)
+	for _, key := range []string{"orders", "orders.1", "a-b_c/d"} {
+		if decoded, err := Decode(codec, key); err != nil || decoded != key {
+			t.Errorf("Decode(%q) = %q, %v, want the key itself", key, decoded, err)
+		}
+	}
+}
+
+func TestEncodePattern(t *testing.T) {
+	tests := []struct {
+		codec   string
+		pattern string
+		want    string
+	}{
+		{Base64URL, "orders.*", "=b3JkZXJz.*"},
+		{Base64URL, "orders.>", "=b3JkZXJz.>"},
+		{Base64URL, ">", ">"},
+		{PathSegment, "orgs.*.æ.>", "orgs.*.=C3=A6.>"},
+		{PathSegment, "ord*", "ord=2A"},
+	}
+	for _, tt := range tests {
+		codec, _ := For(tt.codec)
+		if got := EncodePattern(codec, tt.pattern); got != tt.want {
+			t.Errorf("%s: EncodePattern(%q) = %q, want %q", tt.codec, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestForUnknown(t *testing.T) {
+	if _, err := For("rot13"); err == nil {
+		t.Error("For(\"rot13\") should fail")
+	}
+}
@@ -0,0 +1,137 @@
+package kvwrap
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// WithKey returns the entry with its key replaced
+func WithKey(e nats.KeyValueEntry, key string) nats.KeyValueEntry {
+	if mapped, ok := e.(*entry); ok {
+		c := *mapped
+		c.key = key
+		return &c
+	}
+	return &entry{KeyValueEntry: e, key: key, value: e.Value()}
+}
+
+// WithValue returns the entry with its value replaced
+func WithValue(e nats.KeyValueEntry, value []byte) nats.KeyValueEntry {
+	if mapped, ok := e.(*entry); ok {
+		c := *mapped
+		c.value = value
+		return &c
+	}
+	return &entry{KeyValueEntry: e, key: e.Key(), value: value}
+}
+
+type entry struct {
+	nats.KeyValueEntry
+	key   string
+	value []byte
+}
+
+func (e *entry) Key() string {
+	return e.key
+}
+
+func (e *entry) Value() []byte {
+	return e.value
+}
+
+// MapWatcher passes every update of w through fn, the nil entry marking the end of the initial values is passed on as is
+// fn may return nil to drop an update
+// INFO: mapping a watcher that hasn't been read from yet composes the functions, such that stacked wrappers share one goroutine and channel
+func MapWatcher(w nats.KeyWatcher, fn func(nats.KeyValueEntry) nats.KeyValueEntry) nats.KeyWatcher {
+	if mapped, ok := w.(*keyWatcher); ok && mapped.compose(fn) {
+		return mapped
+	}
+	return &keyWatcher{KeyWatcher: w, fn: fn, stop: make(chan struct{})}
+}
+
+type keyWatcher struct {
+	nats.KeyWatcher
+	mu       sync.Mutex
+	fn       func(nats.KeyValueEntry) nats.KeyValueEntry
+	updates  chan nats.KeyValueEntry
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// compose fails once updates are being forwarded
+func (w *keyWatcher) compose(fn func(nats.KeyValueEntry) nats.KeyValueEntry) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.updates != nil {
+		return false
+	}
+	inner := w.fn
+	w.fn = func(e nats.KeyValueEntry) nats.KeyValueEntry {
+		if e = inner(e); e == nil {
+			return nil
+		}
+		return fn(e)
+	}
+	return true
+}
+
+func (w *keyWatcher) Updates() <-chan nats.KeyValueEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.updates == nil {
+		w.updates = make(chan nats.KeyValueEntry, 256)
+		go w.forward(w.fn)
+	}
+	return w.updates
+}
+
+func (w *keyWatcher) forward(fn func(nats.KeyValueEntry) nats.KeyValueEntry) {
+	defer close(w.updates)
+	for e := range w.KeyWatcher.Updates() {
+		if e != nil {
+			if e = fn(e); e == nil {
+				continue
+			}
+		}
+		select {
+		case w.updates <- e:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *keyWatcher) Stop() error {
+	w.stopOnce.Do(func() { close(w.stop) })
+	return w.KeyWatcher.Stop()
+}
+
+// WatcherLister lists the keys of a watcher until the initial values have been received
+func WatcherLister(w nats.KeyWatcher) nats.KeyLister {
+	kl := &watcherLister{watcher: w, keys: make(chan string, 256)}
+	go func() {
+		defer close(kl.keys)
+		defer w.Stop()
+		for e := range w.Updates() {
+			if e == nil {
+				return
+			}
+			kl.keys <- e.Key()
+		}
+	}()
+	return kl
+}
+
+type watcherLister struct {
+	watcher nats.KeyWatcher
+	keys    chan string
+}
+
+func (kl *watcherLister) Keys() <-chan string {
+	return kl.keys
+}
+
+func (kl *watcherLister) Stop() error {
+	return kl.watcher.Stop()
+}
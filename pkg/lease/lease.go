@@ -0,0 +1,97 @@
+package lease
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrHeld is returned when the lease is held, and not expired, by someone else
+var ErrHeld = errors.New("lease is held by another holder")
+
+// Lease is held as long as the entry revision equals Token, the revision only ever increases so it doubles as a fencing token
+type Lease struct {
+	Name string
+	// may be empty, see Acquire
+	Holder  string
+	Token   uint64
+	TTL     time.Duration
+	Expires time.Time
+}
+
+type entry struct {
+	Holder  string `json:"holder"`
+	Expires int64  `json:"expires"`
+}
+
+func key(name string) string {
+	return "lease." + name
+}
+
+func value(holder string, expires time.Time) []byte {
+	// INFO: marshalling a struct of a string and an int can't fail
+	data, _ := json.Marshal(entry{Holder: holder, Expires: expires.UnixNano()})
+	return data
+}
+
+// Acquire takes the lease if it's free or expired, a crashed holder therefore only blocks others until its ttl runs out
+// INFO: a lease still held by the same, non empty, holder is taken over with a new token, e.g. when a renew went through but its reply was lost
+func Acquire(kv nats.KeyValue, name, holder string, ttl time.Duration) (*Lease, error) {
+	expires := time.Now().Add(ttl)
+	current, err := kv.Get(key(name))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		revision, err := kv.Create(key(name), value(holder, expires))
+		if errors.Is(err, nats.ErrKeyExists) {
+			return nil, ErrHeld
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Lease{Name: name, Holder: holder, Token: revision, TTL: ttl, Expires: expires}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var held entry
+	if err := json.Unmarshal(current.Value(), &held); err != nil {
+		return nil, err
+	}
+	ownLease := holder != "" && held.Holder == holder
+	if !ownLease && time.Now().Before(time.Unix(0, held.Expires)) {
+		return nil, ErrHeld
+	}
+	revision, err := kv.Update(key(name), value(holder, expires), current.Revision())
+	if errors.Is(err, nats.ErrKeyExists) {
+		return nil, ErrHeld
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Lease{Name: name, Holder: holder, Token: revision, TTL: ttl, Expires: expires}, nil
+}
+
+// Renew extends the lease by its ttl, it fails with nats.ErrKeyExists if the lease has been taken over since
+func Renew(kv nats.KeyValue, lease *Lease) (*Lease, error) {
+	expires := time.Now().Add(lease.TTL)
+	revision, err := kv.Update(key(lease.Name), value(lease.Holder, expires), lease.Token)
+	if err != nil {
+		return nil, err
+	}
+	return &Lease{Name: lease.Name, Holder: lease.Holder, Token: revision, TTL: lease.TTL, Expires: expires}, nil
+}
+
+// Release frees the lease, it fails with nats.ErrKeyExists if the lease has been taken over since
+func Release(kv nats.KeyValue, lease *Lease) error {
+	return kv.Delete(key(lease.Name), nats.LastRevision(lease.Token))
+}
+
+// CheckName fails with nats.ErrInvalidKey if name doesn't make a valid key in kv, without taking the lease
+// INFO: the key is checked by kv itself, such that key prefixes and encodings of the bucket are taken into account
+func CheckName(kv nats.KeyValue, name string) error {
+	if _, err := kv.Get(key(name)); errors.Is(err, nats.ErrInvalidKey) {
+		return err
+	}
+	return nil
+}
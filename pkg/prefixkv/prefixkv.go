@@ -0,0 +1,127 @@
+package prefixkv
+
+import (
+	"strings"
+
+	"github.com/Mattilsynet/map-nats-kv/pkg/kvwrap"
+	"github.com/nats-io/nats.go"
+)
+
+// KeyValue confines a nats.KeyValue to the keys below a prefix, keys are prefixed going in and stripped coming out
+// INFO: the prefix always ends with a "." such that one prefix can't be a prefix of another, e.g. "a" and "ab"
+type KeyValue struct {
+	nats.KeyValue
+	prefix string
+}
+
+func Wrap(kv nats.KeyValue, prefix string) *KeyValue {
+	if !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &KeyValue{KeyValue: kv, prefix: prefix}
+}
+
+func (kv *KeyValue) key(key string) string {
+	return kv.prefix + key
+}
+
+func (kv *KeyValue) keys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = kv.key(key)
+	}
+	return prefixed
+}
+
+func (kv *KeyValue) entry(entry nats.KeyValueEntry) nats.KeyValueEntry {
+	if entry == nil {
+		return nil
+	}
+	return kvwrap.WithKey(entry, strings.TrimPrefix(entry.Key(), kv.prefix))
+}
+
+func (kv *KeyValue) Get(key string) (nats.KeyValueEntry, error) {
+	entry, err := kv.KeyValue.Get(kv.key(key))
+	return kv.entry(entry), err
+}
+
+func (kv *KeyValue) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	entry, err := kv.KeyValue.GetRevision(kv.key(key), revision)
+	return kv.entry(entry), err
+}
+
+func (kv *KeyValue) Put(key string, value []byte) (uint64, error) {
+	return kv.KeyValue.Put(kv.key(key), value)
+}
+
+func (kv *KeyValue) PutString(key string, value string) (uint64, error) {
+	return kv.KeyValue.PutString(kv.key(key), value)
+}
+
+func (kv *KeyValue) Create(key string, value []byte) (uint64, error) {
+	return kv.KeyValue.Create(kv.key(key), value)
+}
+
+func (kv *KeyValue) Update(key string, value []byte, last uint64) (uint64, error) {
+	return kv.KeyValue.Update(kv.key(key), value, last)
+}
+
+func (kv *KeyValue) Delete(key string, opts ...nats.DeleteOpt) error {
+	return kv.KeyValue.Delete(kv.key(key), opts...)
+}
+
+func (kv *KeyValue) Purge(key string, opts ...nats.DeleteOpt) error {
+	return kv.KeyValue.Purge(kv.key(key), opts...)
+}
+
+func (kv *KeyValue) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	entries, err := kv.KeyValue.History(kv.key(key), opts...)
+	for i, entry := range entries {
+		entries[i] = kv.entry(entry)
+	}
+	return entries, err
+}
+
+func (kv *KeyValue) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.WatchFiltered([]string{keys}, opts...)
+}
+
+func (kv *KeyValue) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.WatchFiltered([]string{nats.AllKeys}, opts...)
+}
+
+func (kv *KeyValue) WatchFiltered(keys []string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	if len(keys) == 0 {
+		keys = []string{nats.AllKeys}
+	}
+	watcher, err := kv.KeyValue.WatchFiltered(kv.keys(keys), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return kvwrap.MapWatcher(watcher, kv.entry), nil
+}
+
+func (kv *KeyValue) Keys(opts ...nats.WatchOpt) ([]string, error) {
+	lister, err := kv.ListKeys(opts...)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key := range lister.Keys() {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, nats.ErrNoKeysFound
+	}
+	return keys, nil
+}
+
+// ListKeys only lists the keys below the prefix, the filtering happens on the server
+func (kv *KeyValue) ListKeys(opts ...nats.WatchOpt) (nats.KeyLister, error) {
+	opts = append(opts, nats.IgnoreDeletes(), nats.MetaOnly())
+	watcher, err := kv.WatchAll(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return kvwrap.WatcherLister(watcher), nil
+}
@@ -0,0 +1,113 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ValidationError lists every way a value fails the schemas of its key
+type ValidationError struct {
+	Key    string
+	Schema string
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("value of %q does not match schema %q: %s", e.Key, e.Schema, strings.Join(e.Errors, "; "))
+}
+
+// refreshAfter is how long a compiled schema is used before its key is read again, writes in between don't read the schema bucket
+const refreshAfter = 30 * time.Second
+
+type compiled struct {
+	revision uint64
+	schema   *gojsonschema.Schema
+	checked  time.Time
+}
+
+// Cache keeps compiled schemas until the schema key gets a new revision, such that schema changes apply within refreshAfter without relinking
+type Cache struct {
+	mu       sync.Mutex
+	compiled map[string]*compiled
+}
+
+func NewCache() *Cache {
+	return &Cache{compiled: make(map[string]*compiled)}
+}
+
+// Validate validates the value against the schema of every pattern matching the key, the schemas are read from bucket by the key the pattern maps to
+// open is only called when a schema has to be read
+// INFO: a missing or broken schema fails the write, rather than letting unvalidated values through
+func (c *Cache) Validate(bucket string, open func() (nats.KeyValue, error), schemas map[string]string, key string, value []byte) error {
+	for pattern, schemaKey := range schemas {
+		if !Match(pattern, key) {
+			continue
+		}
+		schema, err := c.schema(bucket, open, schemaKey)
+		if err != nil {
+			return fmt.Errorf("schema %q for %q: %v", schemaKey, pattern, err)
+		}
+		result, err := schema.Validate(gojsonschema.NewBytesLoader(value))
+		if err != nil {
+			return &ValidationError{Key: key, Schema: schemaKey, Errors: []string{err.Error()}}
+		}
+		if !result.Valid() {
+			verr := &ValidationError{Key: key, Schema: schemaKey}
+			for _, resultErr := range result.Errors() {
+				verr.Errors = append(verr.Errors, resultErr.String())
+			}
+			return verr
+		}
+	}
+	return nil
+}
+
+func (c *Cache) schema(bucket string, open func() (nats.KeyValue, error), schemaKey string) (*gojsonschema.Schema, error) {
+	cacheKey := bucket + "/" + schemaKey
+	c.mu.Lock()
+	cached, ok := c.compiled[cacheKey]
+	c.mu.Unlock()
+	if ok && time.Since(cached.checked) < refreshAfter {
+		return cached.schema, nil
+	}
+	kv, err := open()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := kv.Get(schemaKey)
+	if err != nil {
+		return nil, err
+	}
+	var schema *gojsonschema.Schema
+	if ok && cached.revision == entry.Revision() {
+		schema = cached.schema
+	} else {
+		schema, err = gojsonschema.NewSchema(gojsonschema.NewBytesLoader(entry.Value()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compiled[cacheKey] = &compiled{revision: entry.Revision(), schema: schema, checked: time.Now()}
+	return schema, nil
+}
+
+// Match reports whether the key matches a NATS subject style pattern, "*" matches one token and a trailing ">" the rest
+func Match(pattern, key string) bool {
+	patternTokens, keyTokens := strings.Split(pattern, "."), strings.Split(key, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return i < len(keyTokens)
+		}
+		if i >= len(keyTokens) || token != "*" && token != keyTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(keyTokens)
+}
@@ -0,0 +1,34 @@
+package schema
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders.1", false},
+		{"orders.1", "orders", false},
+		{"orders.*", "orders.1", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.1.items", false},
+		{"*.items", "orders.items", true},
+		{"orders.>", "orders.1", true},
+		{"orders.>", "orders.1.items", true},
+		{"orders.>", "orders", false},
+		{">", "orders", true},
+		{"orders.*.>", "orders.1.items.2", true},
+		{"orders.*.>", "orders.1", false},
+		{"config.*", "orders.1", false},
+		{"ord*", "orders", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.key, func(t *testing.T) {
+			if got := Match(tt.pattern, tt.key); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,12 +3,16 @@ package secrets
 import (
 	"encoding/base64"
 	"log/slog"
+	"strings"
 
 	"go.wasmcloud.dev/provider"
 )
 
 type Secrets struct {
 	NatsCredentials string
+	// INFO: data encryption keys by id, values are encrypted with DataKeyID. Empty when no data-encryption-keys secret is given
+	DataKeyID string
+	DataKeys  map[string][]byte
 }
 
 func From(secretsMap map[string]provider.SecretValue) *Secrets {
@@ -20,7 +24,41 @@ func From(secretsMap map[string]provider.SecretValue) *Secrets {
 		return nil
 	}
 	slog.Debug("Nats credentials loaded, with size: ", "size", len(natsCredentials))
+	dataKeyID, dataKeys, ok := dataKeysFrom(secretsMap["data-encryption-keys"])
+	if !ok {
+		return nil
+	}
 	return &Secrets{
 		NatsCredentials: string(natsCredentials),
+		DataKeyID:       dataKeyID,
+		DataKeys:        dataKeys,
+	}
+}
+
+// dataKeysFrom reads "<id>=<base64 encoded key>" pairs separated by ",", the first key is the one new values are encrypted with
+func dataKeysFrom(secret provider.SecretValue) (string, map[string][]byte, bool) {
+	value := secret.String.Reveal()
+	if value == "" {
+		return "", nil, true
+	}
+	dataKeyID := ""
+	dataKeys := make(map[string][]byte)
+	for _, item := range strings.Split(value, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			slog.Error("Data encryption key must be given as <id>=<base64 encoded key>")
+			return "", nil, false
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			slog.Error("Data encryption key is not base64 encoded", "id", id)
+			return "", nil, false
+		}
+		if dataKeyID == "" {
+			dataKeyID = id
+		}
+		dataKeys[id] = key
 	}
+	slog.Debug("Data encryption keys loaded", "active", dataKeyID, "count", len(dataKeys))
+	return dataKeyID, dataKeys, true
 }
@@ -0,0 +1,56 @@
+package watchstate
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Store keeps the last revision delivered to a component per watch, such that a watch can resume where it left off after a restart
+type Store struct {
+	kv nats.KeyValue
+}
+
+// New binds to the provider owned bucket, creating it if it doesn't exist
+func New(js nats.JetStreamContext, bucket string) (*Store, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "map-nats-kv: last delivered revision per watch",
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Store{kv: kv}, nil
+}
+
+// Key identifies a watch by link, bucket and (optional) key pattern, a component with several watcher links keeps one state per link
+// INFO: link names and patterns contain characters which are not valid in keys, hence the encoding
+func Key(link, bucket, pattern string) string {
+	key := base64.RawURLEncoding.EncodeToString([]byte(link)) + "." + bucket
+	if pattern != "" {
+		key += "." + base64.RawURLEncoding.EncodeToString([]byte(pattern))
+	}
+	return key
+}
+
+// LastDelivered returns 0 if nothing has been delivered yet
+func (s *Store) LastDelivered(key string) (uint64, error) {
+	entry, err := s.kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(entry.Value()), 10, 64)
+}
+
+func (s *Store) SetLastDelivered(key string, revision uint64) error {
+	_, err := s.kv.PutString(key, strconv.FormatUint(revision, 10))
+	return err
+}
@@ -2,223 +2,861 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Mattilsynet/map-nats-kv/bindings/exports/mattilsynet/map_kv/key_value"
 	"github.com/Mattilsynet/map-nats-kv/bindings/mattilsynet/map_kv/key_value_watcher"
 	"github.com/Mattilsynet/map-nats-kv/bindings/mattilsynet/map_kv/types"
+	"github.com/Mattilsynet/map-nats-kv/pkg/chunked"
+	"github.com/Mattilsynet/map-nats-kv/pkg/compressedkv"
 	"github.com/Mattilsynet/map-nats-kv/pkg/config"
+	"github.com/Mattilsynet/map-nats-kv/pkg/encryptedkv"
+	"github.com/Mattilsynet/map-nats-kv/pkg/keycodec"
 	"github.com/Mattilsynet/map-nats-kv/pkg/pkgnats"
+	"github.com/Mattilsynet/map-nats-kv/pkg/prefixkv"
+	"github.com/Mattilsynet/map-nats-kv/pkg/schema"
 	"github.com/Mattilsynet/map-nats-kv/pkg/secrets"
+	"github.com/Mattilsynet/map-nats-kv/pkg/watchstate"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
 	sdk "go.wasmcloud.dev/provider"
 	wrpc "wrpc.io/go"
 	wrpcnats "wrpc.io/go/nats"
 )
 
+var errUnauthorized = types.NewErrorUnauthorized()
+
+const defaultPageSize = 1000
+
+// maxPageSize caps the page size a component asks for, the page is held in memory while the keys are scanned
+const maxPageSize = 10000
+
+// maxBatchConcurrency bounds the number of concurrent JetStream requests for a single get-many or put-many call
+const maxBatchConcurrency = 16
+
+// maxIncrementRetries bounds the compare-and-swap attempts of a single increment
+const maxIncrementRetries = 10
+
+// a failed watch delivery is retried after minWatchRetry, doubling up to maxWatchRetry, and skipped after maxWatchDeliveries attempts
+const (
+	minWatchRetry      = 500 * time.Millisecond
+	maxWatchRetry      = 30 * time.Second
+	maxWatchDeliveries = 10
+)
+
+var errInvalidSecrets = errors.New("invalid link secrets")
+
+var errNotLinked = errors.New("link is not registered")
+
+var errNoSchemaBucket = errors.New("schemas are configured without a schema_bucket")
+
+var errIncrementContention = fmt.Errorf("increment gave up after %d attempts due to concurrent updates", maxIncrementRetries)
+
+var errIncrementOverflow = errors.New("increment overflows the 64 bit counter")
+
 type KvHandler struct {
 	// The provider instance
 	provider   *sdk.WasmcloudProvider
 	linkedFrom map[string]map[string]string
 	linkedTo   map[string]map[string]string
-	ncMap      map[string]*nats.Conn
-	configs    map[string]*config.Config
+	links      map[string]*linkState
+	// guards linkedFrom, linkedTo and links, which link handlers write while requests, watches and campaigns read them
+	linksMu sync.RWMutex
+	// compiled json schemas, shared by every link
+	schemas *schema.Cache
+	// identifies this provider instance as holder of election leases
+	instanceID  string
+	campaigns   map[string]context.CancelFunc
+	campaignsMu sync.Mutex
+}
+
+// linkState is what the provider keeps per link, it's only stored once the link has been registered successfully
+type linkState struct {
+	nc     *nats.Conn
+	config *config.Config
+	// data encryption keys, values are stored in plaintext when nil
+	keyring *encryptedkv.Keyring
+	// ends the watches of a key-value-watcher link, set once they're started
+	cancelWatch context.CancelFunc
 }
 
 func NewKvHandler(linkedFrom, linkedTo map[string]map[string]string) *KvHandler {
 	return &KvHandler{
 		linkedFrom: linkedFrom,
 		linkedTo:   linkedTo,
-		configs:    make(map[string]*config.Config),
-		ncMap:      make(map[string]*nats.Conn),
+		links:      make(map[string]*linkState),
+		schemas:    schema.NewCache(),
+		instanceID: nuid.Next(),
+		campaigns:  make(map[string]context.CancelFunc),
 	}
 }
 
 func (ha *KvHandler) RegisterComponent(sourceID string, target string, config *config.Config, secrets *secrets.Secrets) error {
+	if secrets == nil {
+		ha.provider.Logger.Error("Invalid (key-value) link secrets", "sourceId", sourceID, "target", target)
+		return errInvalidSecrets
+	}
+	keyring, err := keyringFrom(secrets)
+	if err != nil {
+		ha.provider.Logger.Error("Invalid (key-value) data encryption keys", "sourceId", sourceID, "target", target, "error", err)
+		return err
+	}
 	url := config.NatsURL
 	nc, err := pkgnats.CreateNatsConnection(sourceID, secrets.NatsCredentials, url)
 	if err != nil {
 		ha.provider.Logger.Error("Failed to create (key-value) NATS connection", "sourceId", sourceID, "target", target, "error", err)
 		return err
 	}
-	ha.ncMap[sourceID] = nc
-	ha.configs[sourceID] = config
+	ha.linksMu.Lock()
+	defer ha.linksMu.Unlock()
+	ha.links[sourceID] = &linkState{nc: nc, config: config, keyring: keyring}
 	return nil
 }
 
 func (ha *KvHandler) InitiateNatsWatchAll(sourceID string, target string, config *config.Config, secrets *secrets.Secrets) error {
+	if secrets == nil {
+		ha.provider.Logger.Error("Invalid (key-value-watcher) link secrets", "sourceId", sourceID, "target", target)
+		return errInvalidSecrets
+	}
+	if err := config.ValidateWatch(); err != nil {
+		ha.provider.Logger.Error("Invalid (key-value-watcher) link config", "sourceId", sourceID, "target", target, "error", err)
+		return err
+	}
+	keyring, err := keyringFrom(secrets)
+	if err != nil {
+		ha.provider.Logger.Error("Invalid (key-value-watcher) data encryption keys", "sourceId", sourceID, "target", target, "error", err)
+		return err
+	}
 	url := config.NatsURL
 	nc, err := pkgnats.CreateNatsConnection(sourceID, secrets.NatsCredentials, url)
 	if err != nil {
 		ha.provider.Logger.Error("Failed to create (key-value-watcher) NATS connection", "sourceId", sourceID, "target", target, "error", err)
 		return err
 	}
-	ha.ncMap[sourceID] = nc
-	ha.configs[sourceID] = config
+	ha.linksMu.Lock()
+	defer ha.linksMu.Unlock()
+	ha.links[sourceID] = &linkState{nc: nc, config: config, keyring: keyring}
 	return nil
 }
 
+// keyringFrom returns nil when the link has no data encryption keys
+func keyringFrom(secrets *secrets.Secrets) (*encryptedkv.Keyring, error) {
+	if len(secrets.DataKeys) == 0 {
+		return nil, nil
+	}
+	return encryptedkv.NewKeyring(secrets.DataKeyID, secrets.DataKeys)
+}
+
 func (ha *KvHandler) DeRegisterComponent(sourceID string) {
-	ha.ncMap[sourceID].Close()
-	delete(ha.ncMap, sourceID)
+	ha.linksMu.Lock()
+	defer ha.linksMu.Unlock()
+	delete(ha.linkedFrom, sourceID)
+	ha.deRegister(sourceID)
 }
 
 func (ha *KvHandler) DeRegisterComponentWatchAll(target string) {
-	ha.ncMap[target].Close()
-	delete(ha.ncMap, target)
+	ha.linksMu.Lock()
+	defer ha.linksMu.Unlock()
+	delete(ha.linkedTo, target)
+	ha.deRegister(target)
+}
+
+// deRegister expects linksMu to be held
+func (ha *KvHandler) deRegister(name string) {
+	if link, ok := ha.links[name]; ok {
+		if link.cancelWatch != nil {
+			link.cancelWatch()
+		}
+		link.nc.Close()
+	}
+	delete(ha.links, name)
 }
 
 func (ha *KvHandler) DeferAllNatsConnections() {
-	for _, nc := range ha.ncMap {
-		nc.Close()
+	ha.linksMu.Lock()
+	defer ha.linksMu.Unlock()
+	for _, link := range ha.links {
+		if link.cancelWatch != nil {
+			link.cancelWatch()
+		}
+		link.nc.Close()
+	}
+	clear(ha.links)
+	clear(ha.linkedFrom)
+	clear(ha.linkedTo)
+}
+
+// MarkLinkedFrom lets the component's requests through, call it once the link is registered
+func (ha *KvHandler) MarkLinkedFrom(name string, config map[string]string) {
+	ha.linksMu.Lock()
+	defer ha.linksMu.Unlock()
+	ha.linkedFrom[name] = config
+}
+
+func (ha *KvHandler) MarkLinkedTo(name string, config map[string]string) {
+	ha.linksMu.Lock()
+	defer ha.linksMu.Unlock()
+	ha.linkedTo[name] = config
+}
+
+func (ha *KvHandler) IsLinkedFrom(name string) bool {
+	ha.linksMu.RLock()
+	defer ha.linksMu.RUnlock()
+	_, ok := ha.linkedFrom[name]
+	return ok
+}
+
+func (ha *KvHandler) IsLinkedTo(name string) bool {
+	ha.linksMu.RLock()
+	defer ha.linksMu.RUnlock()
+	_, ok := ha.linkedTo[name]
+	return ok
+}
+
+// link returns errNotLinked rather than a nil state, e.g. when the link failed to register or has been deleted
+func (ha *KvHandler) link(name string) (*linkState, error) {
+	ha.linksMu.RLock()
+	defer ha.linksMu.RUnlock()
+	link, ok := ha.links[name]
+	if !ok {
+		return nil, errNotLinked
 	}
-	clear(ha.ncMap)
+	return link, nil
+}
+
+// INFO: a component can be linked once per package, e.g. both to key-value and to wasi:keyvalue/store, each link with its own config and connection
+const (
+	mapKvPackage  = "mattilsynet:map-kv"
+	wasiKvPackage = "wasi:keyvalue"
+)
+
+// targetLinkName keys the state of a link from a component to the provider
+func targetLinkName(component, pkg string) string {
+	return component + "/" + pkg
 }
 
+// sourceLinkName keys the state of a link from the provider to a watching component
+func sourceLinkName(component, pkg string) string {
+	return component + "/" + pkg + "/watcher"
+}
+
+// componentOf returns the component of a link name
+func componentOf(name string) string {
+	component, _, _ := strings.Cut(name, "/")
+	return component
+}
+
+// isLinkedWith returns the name of the calling component's mattilsynet:map-kv link
 func (ha *KvHandler) isLinkedWith(ctx context.Context) (bool, string) {
+	return ha.isLinkedWithPackage(ctx, mapKvPackage)
+}
+
+func (ha *KvHandler) isLinkedWithPackage(ctx context.Context, pkg string) (bool, string) {
 	header, ok := wrpcnats.HeaderFromContext(ctx)
 	if !ok {
 		ha.provider.Logger.Warn("Received request from unknown origin")
 		return false, ""
 	}
 	target := header.Get("source-id")
+	name := targetLinkName(target, pkg)
 	// Only allow requests from a linked component
-	if ha.linkedFrom[target] == nil {
-		ha.provider.Logger.Warn("Received request from unlinked target", "target", target)
+	if !ha.IsLinkedFrom(name) {
+		ha.provider.Logger.Warn("Received request from unlinked target", "target", target, "package", pkg)
 		return false, ""
 	}
-	return true, target
+	return true, name
 }
 
 // TODO:
 // all of list-keys interface (get, purge, delete, etc, to be refactored since they share same logic)
-func (ha *KvHandler) Get(ctx__ context.Context, key string) (*wrpc.Result[key_value.KeyValueEntry, string], error) {
+func (ha *KvHandler) Get(ctx__ context.Context, key string) (*wrpc.Result[key_value.KeyValueEntry, key_value.Error], error) {
+	return ha.get(ctx__, "", key)
+}
+
+func (ha *KvHandler) get(ctx__ context.Context, store string, key string) (*wrpc.Result[key_value.KeyValueEntry, key_value.Error], error) {
 	isLinked, target := ha.isLinkedWith(ctx__)
 	if !isLinked {
-		return wrpc.Err[key_value.KeyValueEntry]("Unauthorized"), nil
+		return wrpc.Err[key_value.KeyValueEntry](*errUnauthorized), nil
 	}
-	kv, err := ha.getKvByConfigAndNatsConnection(target)
+	kv, err := ha.getKvByStore(target, store)
 	if err != nil {
 		ha.provider.Logger.Error("error getting kv", "error", err)
-		return nil, err
+		return wrpc.Err[key_value.KeyValueEntry](*natsErrToWit(err)), nil
 	}
 	kve, kvGetErr := kv.Get(key)
 	witResult := keyValErrToWit(kve, kvGetErr)
 	return witResult, nil
 }
 
-func keyValErrToWit(a nats.KeyValueEntry, err error) *wrpc.Result[key_value.KeyValueEntry, string] {
+func (ha *KvHandler) GetMany(ctx__ context.Context, keys []string) (*wrpc.Result[[]*wrpc.Result[key_value.KeyValueEntry, key_value.Error], key_value.Error], error) {
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[[]*wrpc.Result[key_value.KeyValueEntry, key_value.Error]](*errUnauthorized), nil
+	}
+	kv, err := ha.getKvByConfigAndNatsConnection(target)
 	if err != nil {
-		return wrpc.Err[key_value.KeyValueEntry](err.Error())
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[[]*wrpc.Result[key_value.KeyValueEntry, key_value.Error]](*natsErrToWit(err)), nil
+	}
+	results := make([]*wrpc.Result[key_value.KeyValueEntry, key_value.Error], len(keys))
+	runBatch(len(keys), func(i int) {
+		kve, kvGetErr := kv.Get(keys[i])
+		results[i] = keyValErrToWit(kve, kvGetErr)
+	})
+	return wrpc.Ok[key_value.Error](results), nil
+}
+
+func (ha *KvHandler) GetRevision(ctx__ context.Context, key string, revision uint64) (*wrpc.Result[key_value.KeyValueEntry, key_value.Error], error) {
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[key_value.KeyValueEntry](*errUnauthorized), nil
 	}
-	witKve := key_value.KeyValueEntry{
-		Key:   a.Key(),
-		Value: a.Value(),
+	kv, err := ha.getKvByConfigAndNatsConnection(target)
+	if err != nil {
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[key_value.KeyValueEntry](*natsErrToWit(err)), nil
 	}
-	return wrpc.Ok[string](witKve)
+	kve, kvGetErr := kv.GetRevision(key, revision)
+	witResult := keyValErrToWit(kve, kvGetErr)
+	return witResult, nil
 }
 
-func (ha *KvHandler) Put(ctx__ context.Context, key string, value []uint8) (*wrpc.Result[struct{}, string], error) {
+func (ha *KvHandler) History(ctx__ context.Context, key string) (*wrpc.Result[[]*key_value.KeyValueEntry, key_value.Error], error) {
 	isLinked, target := ha.isLinkedWith(ctx__)
 	if !isLinked {
-		return wrpc.Err[struct{}]("Unauthorized"), nil
+		return wrpc.Err[[]*key_value.KeyValueEntry](*errUnauthorized), nil
 	}
 	kv, err := ha.getKvByConfigAndNatsConnection(target)
 	if err != nil {
 		ha.provider.Logger.Error("error getting kv", "error", err)
-		return nil, err
+		return wrpc.Err[[]*key_value.KeyValueEntry](*natsErrToWit(err)), nil
+	}
+	kves, kvHistoryErr := kv.History(key)
+	if kvHistoryErr != nil {
+		return wrpc.Err[[]*key_value.KeyValueEntry](*natsErrToWit(kvHistoryErr)), nil
+	}
+	entries := make([]*key_value.KeyValueEntry, 0, len(kves))
+	for _, kve := range kves {
+		entries = append(entries, toWitKeyValueEntry(kve))
+	}
+	return wrpc.Ok[key_value.Error](entries), nil
+}
+
+func keyValErrToWit(a nats.KeyValueEntry, err error) *wrpc.Result[key_value.KeyValueEntry, key_value.Error] {
+	if err != nil {
+		return wrpc.Err[key_value.KeyValueEntry](*natsErrToWit(err))
+	}
+	return wrpc.Ok[key_value.Error](*toWitKeyValueEntry(a))
+}
+
+// natsErrToWit is the one place where nats errors are translated to the wit error variant
+func natsErrToWit(err error) *types.Error {
+	switch {
+	case errors.Is(err, nats.ErrKeyNotFound), errors.Is(err, nats.ErrKeyDeleted), errors.Is(err, nats.ErrObjectNotFound):
+		return types.NewErrorNotFound()
+	// INFO: nats.ErrKeyExists matches the JetStream wrong last sequence error, which is what both create and update fail with
+	case errors.Is(err, nats.ErrKeyExists):
+		return types.NewErrorWrongLastRevision()
+	case errors.Is(err, nats.ErrBucketNotFound), errors.Is(err, nats.ErrStreamNotFound):
+		return types.NewErrorBucketNotFound()
+	case errors.Is(err, nats.ErrInvalidKey):
+		return types.NewErrorInvalidKey()
+	case errors.As(err, new(*schema.ValidationError)):
+		return types.NewErrorInvalidValue(err.Error())
+	case errors.Is(err, nats.ErrConnectionClosed),
+		errors.Is(err, nats.ErrConnectionReconnecting),
+		errors.Is(err, nats.ErrNoResponders),
+		errors.Is(err, nats.ErrTimeout),
+		errors.Is(err, nats.ErrJetStreamNotEnabled),
+		errors.Is(err, context.DeadlineExceeded):
+		return types.NewErrorUnavailable()
+	default:
+		return types.NewErrorOther(err.Error())
+	}
+}
+
+func toWitKeyValueEntry(a nats.KeyValueEntry) *types.KeyValueEntry {
+	return &types.KeyValueEntry{
+		Key:      a.Key(),
+		Value:    a.Value(),
+		Op:       a.Operation().String(),
+		Revision: a.Revision(),
+		Created:  uint64(a.Created().UnixNano()),
+		Delta:    a.Delta(),
+	}
+}
+
+func toWitWatchEvent(a nats.KeyValueEntry) *types.WatchEvent {
+	return &types.WatchEvent{
+		Key:       a.Key(),
+		Value:     a.Value(),
+		Operation: toWitOperation(a.Operation()),
+		Revision:  a.Revision(),
+		Bucket:    a.Bucket(),
+		Created:   uint64(a.Created().UnixNano()),
+		Delta:     a.Delta(),
+	}
+}
+
+func toWitOperation(op nats.KeyValueOp) types.Operation {
+	switch op {
+	case nats.KeyValueDelete:
+		return types.Operation_Delete
+	case nats.KeyValuePurge:
+		return types.Operation_Purge
+	default:
+		return types.Operation_Put
+	}
+}
+
+func (ha *KvHandler) Put(ctx__ context.Context, key string, value []uint8) (*wrpc.Result[struct{}, key_value.Error], error) {
+	return ha.put(ctx__, "", key, value)
+}
+
+func (ha *KvHandler) put(ctx__ context.Context, store string, key string, value []uint8) (*wrpc.Result[struct{}, key_value.Error], error) {
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[struct{}](*errUnauthorized), nil
+	}
+	kv, err := ha.getKvByStore(target, store)
+	if err != nil {
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	if err := ha.validate(target, key, value); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
 	}
 	_, kvPutErr := kv.Put(key, value)
 	if kvPutErr != nil {
-		return wrpc.Err[struct{}](kvPutErr.Error()), nil
+		return wrpc.Err[struct{}](*natsErrToWit(kvPutErr)), nil
+	}
+	return wrpc.Ok[key_value.Error](struct{}{}), nil
+}
+
+// PutStream splits the value over several keys, such that it can exceed both the wRPC frame and the bucket's max value size
+func (ha *KvHandler) PutStream(ctx__ context.Context, key string, value io.ReadCloser) (*wrpc.Result[struct{}, key_value.Error], error) {
+	defer value.Close()
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[struct{}](*errUnauthorized), nil
+	}
+	kv, err := ha.getChunkedKv(target, "")
+	if err != nil {
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	if _, err := kv.PutStream(key, value); err != nil {
+		ha.provider.Logger.Error("error putting chunked value", "key", key, "error", err)
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[key_value.Error](struct{}{}), nil
+}
+
+// GetStream streams values written by put-stream chunk by chunk, and other values as they are
+func (ha *KvHandler) GetStream(ctx__ context.Context, key string) (*wrpc.Result[io.ReadCloser, key_value.Error], error) {
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[io.ReadCloser](*errUnauthorized), nil
+	}
+	kv, err := ha.getChunkedKv(target, "")
+	if err != nil {
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[io.ReadCloser](*natsErrToWit(err)), nil
 	}
-	return wrpc.Ok[string](struct{}{}), nil
+	value, err := kv.GetStream(key)
+	if err != nil {
+		return wrpc.Err[io.ReadCloser](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[key_value.Error](value), nil
 }
 
-func (ha *KvHandler) Purge(ctx__ context.Context, key string) (*wrpc.Result[struct{}, string], error) {
+func (ha *KvHandler) PutMany(ctx__ context.Context, entries []*key_value.KeyValuePair) (*wrpc.Result[[]*wrpc.Result[struct{}, key_value.Error], key_value.Error], error) {
 	isLinked, target := ha.isLinkedWith(ctx__)
 	if !isLinked {
-		return wrpc.Err[struct{}]("Unauthorized"), nil
+		return wrpc.Err[[]*wrpc.Result[struct{}, key_value.Error]](*errUnauthorized), nil
 	}
 	kv, err := ha.getKvByConfigAndNatsConnection(target)
 	if err != nil {
 		ha.provider.Logger.Error("error getting kv", "error", err)
-		return nil, err
+		return wrpc.Err[[]*wrpc.Result[struct{}, key_value.Error]](*natsErrToWit(err)), nil
 	}
-	kvPurgeErr := kv.Purge(key)
-	if kvPurgeErr != nil {
-		return wrpc.Err[struct{}](kvPurgeErr.Error()), nil
+	results := make([]*wrpc.Result[struct{}, key_value.Error], len(entries))
+	runBatch(len(entries), func(i int) {
+		if err := ha.validate(target, entries[i].Key, entries[i].Value); err != nil {
+			results[i] = wrpc.Err[struct{}](*natsErrToWit(err))
+			return
+		}
+		_, kvPutErr := kv.Put(entries[i].Key, entries[i].Value)
+		if kvPutErr != nil {
+			results[i] = wrpc.Err[struct{}](*natsErrToWit(kvPutErr))
+			return
+		}
+		results[i] = wrpc.Ok[key_value.Error](struct{}{})
+	})
+	return wrpc.Ok[key_value.Error](results), nil
+}
+
+// runBatch calls fn for every index in [0, n) with at most maxBatchConcurrency calls in flight
+func runBatch(n int, fn func(i int)) {
+	sem := make(chan struct{}, maxBatchConcurrency)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+func (ha *KvHandler) Update(ctx__ context.Context, key string, value []uint8, lastRevision uint64) (*wrpc.Result[uint64, key_value.Error], error) {
+	return ha.update(ctx__, "", key, value, lastRevision)
+}
+
+func (ha *KvHandler) update(ctx__ context.Context, store string, key string, value []uint8, lastRevision uint64) (*wrpc.Result[uint64, key_value.Error], error) {
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[uint64](*errUnauthorized), nil
+	}
+	kv, err := ha.getKvByStore(target, store)
+	if err != nil {
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[uint64](*natsErrToWit(err)), nil
 	}
-	return wrpc.Ok[string](struct{}{}), nil
+	if err := ha.validate(target, key, value); err != nil {
+		return wrpc.Err[uint64](*natsErrToWit(err)), nil
+	}
+	revision, kvUpdateErr := kv.Update(key, value, lastRevision)
+	if kvUpdateErr != nil {
+		return wrpc.Err[uint64](*natsErrToWit(kvUpdateErr)), nil
+	}
+	return wrpc.Ok[key_value.Error](revision), nil
 }
 
-func (ha *KvHandler) Delete(ctx__ context.Context, key string) (*wrpc.Result[struct{}, string], error) {
+func (ha *KvHandler) Increment(ctx__ context.Context, key string, delta int64) (*wrpc.Result[int64, key_value.Error], error) {
 	isLinked, target := ha.isLinkedWith(ctx__)
 	if !isLinked {
-		return wrpc.Err[struct{}]("Unauthorized"), nil
+		return wrpc.Err[int64](*errUnauthorized), nil
 	}
 	kv, err := ha.getKvByConfigAndNatsConnection(target)
 	if err != nil {
 		ha.provider.Logger.Error("error getting kv", "error", err)
-		return nil, err
+		return wrpc.Err[int64](*natsErrToWit(err)), nil
 	}
-	err = kv.Delete(key)
+	value, err := incrementCounter(kv, key, delta, func(value []byte) error { return ha.validate(target, key, value) })
+	if err != nil {
+		ha.provider.Logger.Warn("error incrementing key", "key", key, "error", err)
+		return wrpc.Err[int64](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[key_value.Error](value), nil
+}
+
+// incrementCounter is a compare-and-swap retry loop on kv.Update, counters are stored as decimal strings
+// validate is given every value before it's written, such that counters are held to the schemas of their keys like any other value
+func incrementCounter(kv nats.KeyValue, key string, delta int64, validate func(value []byte) error) (int64, error) {
+	for range maxIncrementRetries {
+		kve, err := kv.Get(key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			value := []byte(strconv.FormatInt(delta, 10))
+			if err := validate(value); err != nil {
+				return 0, err
+			}
+			// INFO: Create rather than Update with revision 0, since a deleted key still has a delete marker revision
+			_, err = kv.Create(key, value)
+			if errors.Is(err, nats.ErrKeyExists) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			return delta, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		current, err := strconv.ParseInt(string(kve.Value()), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("value of key %q is not a counter: %w", key, err)
+		}
+		next := current + delta
+		if delta > 0 && next < current || delta < 0 && next > current {
+			return 0, fmt.Errorf("%w: %d + %d", errIncrementOverflow, current, delta)
+		}
+		value := []byte(strconv.FormatInt(next, 10))
+		if err := validate(value); err != nil {
+			return 0, err
+		}
+		_, err = kv.Update(key, value, kve.Revision())
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return next, nil
+	}
+	return 0, errIncrementContention
+}
+
+func (ha *KvHandler) Purge(ctx__ context.Context, key string) (*wrpc.Result[struct{}, key_value.Error], error) {
+	return ha.purge(ctx__, "", key)
+}
+
+func (ha *KvHandler) PurgeIfRevision(ctx__ context.Context, key string, lastRevision uint64) (*wrpc.Result[struct{}, key_value.Error], error) {
+	return ha.purge(ctx__, "", key, nats.LastRevision(lastRevision))
+}
+
+func (ha *KvHandler) purge(ctx__ context.Context, store string, key string, opts ...nats.DeleteOpt) (*wrpc.Result[struct{}, key_value.Error], error) {
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[struct{}](*errUnauthorized), nil
+	}
+	kv, err := ha.getKvByStore(target, store)
+	if err != nil {
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	kvPurgeErr := kv.Purge(key, opts...)
+	if kvPurgeErr != nil {
+		return wrpc.Err[struct{}](*natsErrToWit(kvPurgeErr)), nil
+	}
+	return wrpc.Ok[key_value.Error](struct{}{}), nil
+}
+
+func (ha *KvHandler) Delete(ctx__ context.Context, key string) (*wrpc.Result[struct{}, key_value.Error], error) {
+	return ha.delete(ctx__, "", key)
+}
+
+func (ha *KvHandler) DeleteIfRevision(ctx__ context.Context, key string, lastRevision uint64) (*wrpc.Result[struct{}, key_value.Error], error) {
+	return ha.delete(ctx__, "", key, nats.LastRevision(lastRevision))
+}
+
+func (ha *KvHandler) delete(ctx__ context.Context, store string, key string, opts ...nats.DeleteOpt) (*wrpc.Result[struct{}, key_value.Error], error) {
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[struct{}](*errUnauthorized), nil
+	}
+	kv, err := ha.getKvByStore(target, store)
+	if err != nil {
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	err = kv.Delete(key, opts...)
 	if err != nil {
 		ha.provider.Logger.Error("error deleting key", "key", key, "error", err)
-		return wrpc.Err[struct{}](err.Error()), nil
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
 	}
-	return wrpc.Ok[string](struct{}{}), nil
+	return wrpc.Ok[key_value.Error](struct{}{}), nil
+}
+
+func (ha *KvHandler) Create(ctx__ context.Context, key string, value []byte) (*wrpc.Result[struct{}, key_value.Error], error) {
+	return ha.create(ctx__, "", key, value)
 }
 
-func (ha *KvHandler) Create(ctx__ context.Context, key string, value []byte) (*wrpc.Result[struct{}, string], error) {
+func (ha *KvHandler) create(ctx__ context.Context, store string, key string, value []byte) (*wrpc.Result[struct{}, key_value.Error], error) {
 	isLinked, target := ha.isLinkedWith(ctx__)
 	if !isLinked {
-		return wrpc.Err[struct{}]("Unauthorized"), nil
+		return wrpc.Err[struct{}](*errUnauthorized), nil
 	}
-	kv, err := ha.getKvByConfigAndNatsConnection(target)
+	kv, err := ha.getKvByStore(target, store)
 	if err != nil {
 		ha.provider.Logger.Error("error getting kv", "error", err)
-		return nil, err
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
+	}
+	if err := ha.validate(target, key, value); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWit(err)), nil
 	}
 	_, kvCreateErr := kv.Create(key, value)
 	if kvCreateErr != nil {
-		return wrpc.Err[struct{}](kvCreateErr.Error()), nil
+		return wrpc.Err[struct{}](*natsErrToWit(kvCreateErr)), nil
 	}
-	return wrpc.Ok[string](struct{}{}), nil
+	return wrpc.Ok[key_value.Error](struct{}{}), nil
+}
+
+func (ha *KvHandler) ListKeys(ctx__ context.Context) (*wrpc.Result[[]string, key_value.Error], error) {
+	return ha.listKeys(ctx__, "")
 }
 
-func (ha *KvHandler) ListKeys(ctx__ context.Context) (*wrpc.Result[[]string, string], error) {
+func (ha *KvHandler) listKeys(ctx__ context.Context, store string) (*wrpc.Result[[]string, key_value.Error], error) {
 	isLinked, target := ha.isLinkedWith(ctx__)
 	if !isLinked {
-		return wrpc.Err[[]string]("Unauthorized"), nil
+		return wrpc.Err[[]string](*errUnauthorized), nil
 	}
 	ha.provider.Logger.Info("Get request", "target", target)
-	kv, err := ha.getKvByConfigAndNatsConnection(target)
+	kv, err := ha.getKvByStore(target, store)
 	if err != nil {
 		ha.provider.Logger.Error("error getting kv", "error", err)
-		return nil, err
+		return wrpc.Err[[]string](*natsErrToWit(err)), nil
 	}
 	keyChannel, err := kv.ListKeys()
 	if err != nil {
 		ha.provider.Logger.Error("error listing keys", "error", err)
-		return wrpc.Err[[]string](err.Error()), err
+		return wrpc.Err[[]string](*natsErrToWit(err)), nil
 	}
 	keys := []string{}
 	for key := range keyChannel.Keys() {
 		keys = append(keys, key)
 	}
-	return wrpc.Ok[string](keys), nil
+	return wrpc.Ok[key_value.Error](keys), nil
 }
 
-func (ha *KvHandler) RegisterComponentWatchAll(ctx__ context.Context, sourceId, target string) error {
+func (ha *KvHandler) ListKeysPage(ctx__ context.Context, cursor *string, pageSize uint32) (*wrpc.Result[key_value.KeyPage, key_value.Error], error) {
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[key_value.KeyPage](*errUnauthorized), nil
+	}
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	pageSize = min(pageSize, maxPageSize)
+	kv, err := ha.getKvByConfigAndNatsConnection(target)
+	if err != nil {
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[key_value.KeyPage](*natsErrToWit(err)), nil
+	}
+	keyChannel, err := kv.ListKeys(nats.Context(ctx__))
+	if err != nil {
+		ha.provider.Logger.Error("error listing keys", "error", err)
+		return wrpc.Err[key_value.KeyPage](*natsErrToWit(err)), nil
+	}
+	after := ""
+	if cursor != nil {
+		after = *cursor
+	}
+	keys, more := nextKeyPage(keyChannel.Keys(), after, int(pageSize))
+	page := key_value.KeyPage{Keys: keys}
+	if more {
+		page.NextCursor = &keys[len(keys)-1]
+	}
+	return wrpc.Ok[key_value.Error](page), nil
+}
+
+// nextKeyPage keeps only the pageSize lowest keys after the cursor while scanning, so memory is bounded by the page size and not the bucket size
+// pageSize is clamped to 1 through maxPageSize
+func nextKeyPage(keys <-chan string, after string, pageSize int) ([]string, bool) {
+	pageSize = min(max(pageSize, 1), maxPageSize)
+	page := lowestKeys(keys, after, pageSize+1)
+	if len(page) > pageSize {
+		return page[:pageSize], true
+	}
+	return page, false
+}
+
+// lowestKeys returns the n lowest distinct keys after the cursor, sorted
+func lowestKeys(keys <-chan string, after string, n int) []string {
+	lowest := make([]string, 0, min(n, maxPageSize+1))
+	for key := range keys {
+		if key <= after {
+			continue
+		}
+		i, found := slices.BinarySearch(lowest, key)
+		if found || i >= n {
+			continue
+		}
+		lowest = slices.Insert(lowest, i, key)
+		if len(lowest) > n {
+			lowest = lowest[:n]
+		}
+	}
+	return lowest
+}
+
+func (ha *KvHandler) ListKeysFiltered(ctx__ context.Context, patterns []string) (*wrpc.Result[[]string, key_value.Error], error) {
+	isLinked, target := ha.isLinkedWith(ctx__)
+	if !isLinked {
+		return wrpc.Err[[]string](*errUnauthorized), nil
+	}
+	kv, err := ha.getKvByConfigAndNatsConnection(target)
+	if err != nil {
+		ha.provider.Logger.Error("error getting kv", "error", err)
+		return wrpc.Err[[]string](*natsErrToWit(err)), nil
+	}
+	keys, err := listKeysFiltered(ctx__, kv, patterns)
+	if err != nil {
+		ha.provider.Logger.Error("error listing filtered keys", "patterns", patterns, "error", err)
+		return wrpc.Err[[]string](*natsErrToWit(err)), nil
+	}
+	return wrpc.Ok[key_value.Error](keys), nil
+}
+
+// listKeysFiltered lets the server do the filtering by using the patterns as consumer filter subjects
+// INFO: WatchFiltered rewrites the given slice in place, hence the copy
+func listKeysFiltered(ctx context.Context, kv nats.KeyValue, patterns []string) ([]string, error) {
+	watcher, err := kv.WatchFiltered(slices.Clone(patterns), nats.IgnoreDeletes(), nats.MetaOnly(), nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+	keys := []string{}
+	for {
+		select {
+		case entry := <-watcher.Updates():
+			// a nil entry marks that all initial values have been received
+			if entry == nil {
+				return keys, nil
+			}
+			keys = append(keys, entry.Key())
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// watchDeliverFunc delivers a single watch update to the component
+type watchDeliverFunc func(ctx context.Context, client wrpc.Invoker, kvEntry nats.KeyValueEntry) error
+
+// mapKvWatchDelivery delivers through key-value-watcher, fn is either watch or watch-all
+func mapKvWatchDelivery(fn func(ctx__ context.Context, wrpc__ wrpc.Invoker, event *types.WatchEvent) (*wrpc.Result[struct{}, string], error)) watchDeliverFunc {
+	return func(ctx context.Context, client wrpc.Invoker, kvEntry nats.KeyValueEntry) error {
+		response, err := fn(ctx, client, toWitWatchEvent(kvEntry))
+		if err != nil {
+			return err
+		}
+		if response != nil && response.Err != nil {
+			return errors.New(*response.Err)
+		}
+		return nil
+	}
+}
+
+// RegisterComponentWatchAll watches the bucket on behalf of the component, wasiWatcher delivers through wasi:keyvalue/watcher instead of key-value-watcher
+func (ha *KvHandler) RegisterComponentWatchAll(ctx__ context.Context, sourceId, target string, wasiWatcher bool) error {
+	link, err := ha.link(sourceId)
+	if err != nil {
+		return err
+	}
+	// INFO: the watches of a link end with it, deRegister cancels them
+	ctx__, cancel := context.WithCancel(ctx__)
+	ha.linksMu.Lock()
+	link.cancelWatch = cancel
+	ha.linksMu.Unlock()
+	config := link.config
 	kv, err := ha.getKvByConfigAndNatsConnection(sourceId)
-	config := ha.configs[sourceId]
 	if err != nil {
 		ha.provider.Logger.Warn("Failed to getkv", "error", err)
 		return err
 	}
 
-	kvWatcherChannel, natsWatchAllErr := kv.WatchAll(nats.Context(ctx__))
+	watchAllDeliver, watchDeliver := mapKvWatchDelivery(key_value_watcher.WatchAll), mapKvWatchDelivery(key_value_watcher.Watch)
+	if wasiWatcher {
+		watchAllDeliver = wasiWatchDelivery(config.Bucket)
+		watchDeliver = watchAllDeliver
+	}
+	state := ha.openWatchState(sourceId, link)
+	if len(config.WatchKeys) > 0 {
+		return ha.registerComponentWatch(ctx__, kv, sourceId, target, config, state, watchDeliver)
+	}
+	kvWatcherChannel, natsWatchAllErr := kv.WatchAll(watchOpts(ctx__, config)...)
 	if natsWatchAllErr != nil {
 		ha.provider.Logger.Error("Failed to watch all", "sourceId", sourceId, "error", natsWatchAllErr)
 		return natsWatchAllErr
@@ -226,44 +864,339 @@ func (ha *KvHandler) RegisterComponentWatchAll(ctx__ context.Context, sourceId,
 	client := ha.provider.OutgoingRpcClient(target)
 	// INFO: A little delay for the provider to wait for the component to be ready
 	time.Sleep(time.Duration(config.ComponentEstimatedStartupTime) * time.Second)
-	go func() {
-		for {
-			select {
-			case kvEntry := <-kvWatcherChannel.Updates():
-				if kvEntry != nil {
-					keyval := types.KeyValueEntry{}
-
-					keyval.Key = kvEntry.Key()
-					keyval.Value = kvEntry.Value()
-					keyval.Op = kvEntry.Operation().String()
-					ha.provider.Logger.Info("provider", "pre component, key found", string(keyval.Key))
-					response, err := key_value_watcher.WatchAll(ctx__, client, &keyval)
-					if err != nil {
-						ha.provider.Logger.Error("Failed to watch all", "sourceId", sourceId, "error", err)
-					}
-					if response != nil {
-						if response.Err != nil {
-							ha.provider.Logger.Error("Failed to watch all", "sourceId", sourceId, "error", response.Err)
-						}
+	resume := newWatchResume(state, watchstate.Key(sourceId, config.Bucket, ""))
+	go ha.forwardWatchUpdates(ctx__, sourceId, kvWatcherChannel, client, watchAllDeliver, resume)
+	return nil
+}
+
+// registerComponentWatch opens one watcher per key pattern and delivers the updates through watch (or wasi:keyvalue/watcher)
+func (ha *KvHandler) registerComponentWatch(ctx__ context.Context, kv nats.KeyValue, sourceId, target string, config *config.Config, state *watchstate.Store, deliver watchDeliverFunc) error {
+	patterns := config.WatchKeys
+	kvWatchers := make([]nats.KeyWatcher, 0, len(patterns))
+	for _, pattern := range patterns {
+		kvWatcher, natsWatchErr := kv.Watch(pattern, watchOpts(ctx__, config)...)
+		if natsWatchErr != nil {
+			ha.provider.Logger.Error("Failed to watch", "sourceId", sourceId, "pattern", pattern, "error", natsWatchErr)
+			for _, w := range kvWatchers {
+				w.Stop()
+			}
+			return natsWatchErr
+		}
+		kvWatchers = append(kvWatchers, kvWatcher)
+	}
+	client := ha.provider.OutgoingRpcClient(target)
+	// INFO: A little delay for the provider to wait for the component to be ready
+	time.Sleep(time.Duration(config.ComponentEstimatedStartupTime) * time.Second)
+	for i, kvWatcher := range kvWatchers {
+		resume := newWatchResume(state, watchstate.Key(sourceId, config.Bucket, patterns[i]))
+		go ha.forwardWatchUpdates(ctx__, sourceId, kvWatcher, client, deliver, resume)
+	}
+	return nil
+}
+
+// openWatchState returns nil when resuming is disabled or the state bucket can't be opened, the watch then replays from the start
+func (ha *KvHandler) openWatchState(sourceId string, link *linkState) *watchstate.Store {
+	config := link.config
+	if config.WatchStateBucket == "" {
+		return nil
+	}
+	js, err := link.nc.JetStream()
+	if err != nil {
+		ha.provider.Logger.Warn("Failed to create JetStream context for watch state", "sourceId", sourceId, "error", err)
+		return nil
+	}
+	state, err := watchstate.New(js, config.WatchStateBucket)
+	if err != nil {
+		ha.provider.Logger.Warn("Failed to open watch state bucket, watch will not resume", "sourceId", sourceId, "bucket", config.WatchStateBucket, "error", err)
+		return nil
+	}
+	return state
+}
+
+// watchResume tracks the last revision delivered by a single watch
+type watchResume struct {
+	state *watchstate.Store
+	key   string
+}
+
+func newWatchResume(state *watchstate.Store, key string) *watchResume {
+	if state == nil {
+		return nil
+	}
+	return &watchResume{state: state, key: key}
+}
+
+func watchOpts(ctx context.Context, config *config.Config) []nats.WatchOpt {
+	opts := []nats.WatchOpt{nats.Context(ctx)}
+	if config.WatchIncludeHistory {
+		opts = append(opts, nats.IncludeHistory())
+	}
+	if config.WatchIgnoreDeletes {
+		opts = append(opts, nats.IgnoreDeletes())
+	}
+	if config.WatchUpdatesOnly {
+		opts = append(opts, nats.UpdatesOnly())
+	}
+	if config.WatchMetaOnly {
+		opts = append(opts, nats.MetaOnly())
+	}
+	return opts
+}
+
+// forwardWatchUpdates delivers every update to the component, if resume is set entries already delivered before a restart are skipped
+// INFO: the watcher only replays the latest value per key (unless history is included), so skipping revisions at or below the last delivered one resumes the watch without delivering a full replay to the component
+func (ha *KvHandler) forwardWatchUpdates(ctx__ context.Context, sourceId string, kvWatcher nats.KeyWatcher, client wrpc.Invoker, deliver watchDeliverFunc, resume *watchResume) {
+	var lastDelivered uint64
+	if resume != nil {
+		revision, err := resume.state.LastDelivered(resume.key)
+		if err != nil {
+			ha.provider.Logger.Warn("Failed to read last delivered revision, replaying from the start", "sourceId", sourceId, "key", resume.key, "error", err)
+		}
+		lastDelivered = revision
+	}
+	defer kvWatcher.Stop()
+	for {
+		select {
+		case kvEntry, ok := <-kvWatcher.Updates():
+			if !ok {
+				ha.provider.Logger.Warn("Watch closed", "sourceId", sourceId)
+				return
+			}
+			if kvEntry != nil && kvEntry.Revision() > lastDelivered {
+				ha.provider.Logger.Info("provider", "pre component, key found", kvEntry.Key())
+				if !ha.deliverWatchUpdate(ctx__, sourceId, client, deliver, kvEntry) {
+					return
+				}
+				if resume != nil {
+					if err := resume.state.SetLastDelivered(resume.key, kvEntry.Revision()); err != nil {
+						ha.provider.Logger.Warn("Failed to store last delivered revision", "sourceId", sourceId, "key", resume.key, "error", err)
 					}
 				}
-			case <-ctx__.Done():
-				ha.provider.Logger.Warn("Context done", "sourceId", sourceId)
-				return
 			}
+		case <-ctx__.Done():
+			ha.provider.Logger.Warn("Context done", "sourceId", sourceId)
+			return
 		}
-	}()
-	return nil
+	}
+}
+
+// deliverWatchUpdate retries a failed delivery, such that an update isn't skipped by a later one being delivered while the component is briefly unavailable
+// An update the component keeps failing is logged and skipped after maxWatchDeliveries, rather than holding up every later update. It returns false when ctx is done first
+func (ha *KvHandler) deliverWatchUpdate(ctx__ context.Context, sourceId string, client wrpc.Invoker, deliver watchDeliverFunc, kvEntry nats.KeyValueEntry) bool {
+	retryIn := minWatchRetry
+	for attempt := 1; ; attempt++ {
+		err := deliver(ctx__, client, kvEntry)
+		if err == nil {
+			return true
+		}
+		if attempt == maxWatchDeliveries {
+			ha.provider.Logger.Error("Failed to deliver watch update, skipping it", "sourceId", sourceId, "key", kvEntry.Key(), "revision", kvEntry.Revision(), "attempts", attempt, "error", err)
+			return true
+		}
+		ha.provider.Logger.Error("Failed to deliver watch update, retrying", "sourceId", sourceId, "key", kvEntry.Key(), "revision", kvEntry.Revision(), "retryIn", retryIn, "error", err)
+		select {
+		case <-time.After(retryIn):
+		case <-ctx__.Done():
+			return false
+		}
+		retryIn = min(retryIn*2, maxWatchRetry)
+	}
 }
 
 func (ha *KvHandler) getKvByConfigAndNatsConnection(name string) (nats.KeyValue, error) {
-	nc := ha.ncMap[name]
-	js, err := nc.JetStream()
+	return ha.getKvByStore(name, "")
+}
+
+// getKvByStore resolves a logical store name to a bucket through the link config, the empty name is the link's default bucket
+func (ha *KvHandler) getKvByStore(name, store string) (nats.KeyValue, error) {
+	kv, err := ha.getChunkedKv(name, store)
 	if err != nil {
-		ha.provider.Logger.Warn("Failed to create JetStream context", "sourceId/target", name, "error", err)
 		return nil, err
 	}
-	config := ha.configs[name]
-	kv, err := js.KeyValue(config.Bucket)
 	return kv, nil
 }
+
+// getChunkedKv is the store's bucket with put-stream and get-stream, writes to it clean up the chunks of streamed values they replace
+func (ha *KvHandler) getChunkedKv(name, store string) (*chunked.KeyValue, error) {
+	link, err := ha.link(name)
+	if err != nil {
+		return nil, err
+	}
+	bucket, ok := link.config.BucketFor(store)
+	if !ok {
+		return nil, fmt.Errorf("%w: no bucket configured for store %q", nats.ErrBucketNotFound, store)
+	}
+	kv, err := ha.getKvByBucket(name, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return chunked.Wrap(kv, &chunksBucket{ha: ha, name: name, bucket: bucket}), nil
+}
+
+// validate checks a value against the json schemas of the link before it's written
+func (ha *KvHandler) validate(name, key string, value []byte) error {
+	link, err := ha.link(name)
+	if err != nil {
+		return err
+	}
+	config := link.config
+	if len(config.Schemas) == 0 {
+		return nil
+	}
+	if config.SchemaBucket == "" {
+		return errNoSchemaBucket
+	}
+	// INFO: the schema bucket is read as is, without the link's key prefix, encoding or encryption
+	open := func() (nats.KeyValue, error) {
+		js, err := link.nc.JetStream()
+		if err != nil {
+			return nil, err
+		}
+		kv, err := js.KeyValue(config.SchemaBucket)
+		if err != nil {
+			ha.provider.Logger.Warn("Failed to bind to schema bucket", "sourceId/target", name, "bucket", config.SchemaBucket, "error", err)
+			return nil, err
+		}
+		return kv, nil
+	}
+	return ha.schemas.Validate(config.SchemaBucket, open, config.Schemas, key, value)
+}
+
+// getLockKv returns the bucket leases are kept in, by default a provider owned bucket next to the link's bucket such that leases don't show up in list-keys and watches
+func (ha *KvHandler) getLockKv(name string) (nats.KeyValue, error) {
+	link, err := ha.link(name)
+	if err != nil {
+		return nil, err
+	}
+	if link.config.LockBucket == "" {
+		return ha.openKv(name, link.config.Bucket+"-leases", link.config.Bucket, "map-nats-kv: lock and election leases of "+link.config.Bucket)
+	}
+	return ha.getKvByBucket(name, link.config.LockBucket)
+}
+
+// chunksBucket is the provider owned bucket next to a store's bucket that put-stream keeps its chunks in, such that chunks don't show up in list-keys and watches
+type chunksBucket struct {
+	ha     *KvHandler
+	name   string
+	bucket string
+}
+
+// Open wraps the chunks' values like the store's values, the chunk keys are stored as they are such that Purge can find them
+func (c *chunksBucket) Open(create bool) (nats.KeyValue, error) {
+	link, err := c.ha.link(c.name)
+	if err != nil {
+		return nil, err
+	}
+	js, err := link.nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	description := ""
+	if create {
+		description = "map-nats-kv: put-stream chunks of " + c.bucket
+	}
+	kv, err := bindKv(js, c.bucket+"-chunks", c.bucket, description)
+	if errors.Is(err, nats.ErrBucketNotFound) && !create {
+		return nil, nil
+	}
+	if err != nil {
+		c.ha.provider.Logger.Warn("Failed to bind to chunks bucket", "sourceId/target", c.name, "bucket", c.bucket+"-chunks", "error", err)
+		return nil, err
+	}
+	return c.ha.wrapValues(c.name, link, kv)
+}
+
+func (c *chunksBucket) Purge(id string) error {
+	link, err := c.ha.link(c.name)
+	if err != nil {
+		return err
+	}
+	js, err := link.nc.JetStream()
+	if err != nil {
+		return err
+	}
+	return chunked.PurgeStream(js, c.bucket+"-chunks", id)
+}
+
+func (ha *KvHandler) getKvByBucket(name, bucket string) (nats.KeyValue, error) {
+	return ha.openKv(name, bucket, "", "")
+}
+
+// openKv binds to the bucket and wraps it according to the link config, the bucket is created next to parent if it doesn't exist and description is set
+func (ha *KvHandler) openKv(name, bucket, parent, description string) (nats.KeyValue, error) {
+	link, err := ha.link(name)
+	if err != nil {
+		return nil, err
+	}
+	config := link.config
+	js, err := link.nc.JetStream()
+	if err != nil {
+		ha.provider.Logger.Warn("Failed to create JetStream context", "sourceId/target", name, "error", err)
+		return nil, err
+	}
+	kv, err := bindKv(js, bucket, parent, description)
+	if err != nil {
+		ha.provider.Logger.Warn("Failed to bind to bucket", "sourceId/target", name, "bucket", bucket, "error", err)
+		return nil, err
+	}
+	// INFO: encryption goes right on the bucket, such that the stored key is what the value is bound to
+	if link.keyring != nil {
+		kv = encryptedkv.Wrap(kv, link.keyring, config.AllowPlaintextValues)
+	}
+	// INFO: the prefix goes outside the encoding, such that the encoded keys are the ones below the prefix
+	if config.KeyPrefix != "" {
+		kv = prefixkv.Wrap(kv, config.KeyPrefix)
+	}
+	if config.KeyEncoding != "" {
+		codec, err := keycodec.For(config.KeyEncoding)
+		if err != nil {
+			ha.provider.Logger.Warn("Invalid key encoding", "sourceId/target", name, "error", err)
+			return nil, err
+		}
+		kv = keycodec.Wrap(kv, codec)
+	}
+	return ha.compressValues(name, link, kv)
+}
+
+// wrapValues encrypts and compresses values like openKv, but leaves the keys as they are
+func (ha *KvHandler) wrapValues(name string, link *linkState, kv nats.KeyValue) (nats.KeyValue, error) {
+	if link.keyring != nil {
+		kv = encryptedkv.Wrap(kv, link.keyring, link.config.AllowPlaintextValues)
+	}
+	return ha.compressValues(name, link, kv)
+}
+
+func (ha *KvHandler) compressValues(name string, link *linkState, kv nats.KeyValue) (nats.KeyValue, error) {
+	if link.config.ValueCompression == "" {
+		return kv, nil
+	}
+	alg, err := compressedkv.Algorithm(link.config.ValueCompression)
+	if err != nil {
+		ha.provider.Logger.Warn("Invalid value compression", "sourceId/target", name, "error", err)
+		return nil, err
+	}
+	return compressedkv.Wrap(kv, alg), nil
+}
+
+// bindKv creates a missing bucket if description is set, with the replicas and storage of parent such that it's as durable as the bucket it belongs to
+func bindKv(js nats.JetStreamContext, bucket, parent, description string) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(bucket)
+	if !errors.Is(err, nats.ErrBucketNotFound) || description == "" {
+		return kv, err
+	}
+	parentKv, err := js.KeyValue(parent)
+	if err != nil {
+		return nil, err
+	}
+	status, err := parentKv.Status()
+	if err != nil {
+		return nil, err
+	}
+	config := &nats.KeyValueConfig{Bucket: bucket, Description: description}
+	if bucketStatus, ok := status.(*nats.KeyValueBucketStatus); ok {
+		streamConfig := bucketStatus.StreamInfo().Config
+		config.Replicas = streamConfig.Replicas
+		config.Storage = streamConfig.Storage
+	}
+	return js.CreateKeyValue(config)
+}
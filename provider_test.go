@@ -0,0 +1,71 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func keyChannel(keys ...string) <-chan string {
+	ch := make(chan string, len(keys))
+	for _, key := range keys {
+		ch <- key
+	}
+	close(ch)
+	return ch
+}
+
+func TestNextKeyPage(t *testing.T) {
+	keys := []string{"d", "b", "a", "e", "c"}
+	tests := []struct {
+		name     string
+		after    string
+		pageSize int
+		want     []string
+		more     bool
+	}{
+		{"first page", "", 2, []string{"a", "b"}, true},
+		{"middle page", "b", 2, []string{"c", "d"}, true},
+		{"last page", "d", 2, []string{"e"}, false},
+		{"exactly the rest", "c", 2, []string{"d", "e"}, false},
+		{"past the end", "e", 2, []string{}, false},
+		{"cursor between keys", "bb", 10, []string{"c", "d", "e"}, false},
+		{"zero page size", "", 0, []string{"a"}, true},
+		{"huge page size", "", 1 << 31, []string{"a", "b", "c", "d", "e"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, more := nextKeyPage(keyChannel(keys...), tt.after, tt.pageSize)
+			if !slices.Equal(got, tt.want) || more != tt.more {
+				t.Errorf("nextKeyPage(%q, %d) = %q, %v, want %q, %v", tt.after, tt.pageSize, got, more, tt.want, tt.more)
+			}
+		})
+	}
+}
+
+func TestNextKeyPageSkipsDuplicates(t *testing.T) {
+	got, more := nextKeyPage(keyChannel("a", "b", "a", "b"), "", 2)
+	if !slices.Equal(got, []string{"a", "b"}) || more {
+		t.Errorf("nextKeyPage = %q, %v, want [a b], false", got, more)
+	}
+}
+
+func TestLowestKeys(t *testing.T) {
+	keys := []string{"d", "b", "a", "e", "c", "b"}
+	tests := []struct {
+		name string
+		n    int
+		want []string
+	}{
+		{"none", 0, []string{}},
+		{"some", 3, []string{"a", "b", "c"}},
+		{"all", 5, []string{"a", "b", "c", "d", "e"}},
+		{"more than there are", 10, []string{"a", "b", "c", "d", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lowestKeys(keyChannel(keys...), "", tt.n); !slices.Equal(got, tt.want) {
+				t.Errorf("lowestKeys(%d) = %q, want %q", tt.n, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/Mattilsynet/map-nats-kv/bindings/exports/wrpc/keyvalue/store"
+	"github.com/Mattilsynet/map-nats-kv/bindings/wrpc/keyvalue/watcher"
+	"github.com/nats-io/nats.go"
+	wrpc "wrpc.io/go"
+)
+
+// maxListOffset caps the list-keys cursor, the keys before the offset are held in memory while the keys are scanned
+const maxListOffset = 1 << 20
+
+var errNegativeCounter = errors.New("counter is negative")
+
+// WasiKvHandler serves the standard wasi:keyvalue store, atomics and batch interfaces, the bucket identifier is resolved like a named-key-value store name
+type WasiKvHandler struct {
+	kvHandler *KvHandler
+}
+
+func NewWasiKvHandler(kvHandler *KvHandler) *WasiKvHandler {
+	return &WasiKvHandler{kvHandler: kvHandler}
+}
+
+// natsErrToWasi translates nats errors to the wasi:keyvalue error variant
+func natsErrToWasi(err error) *store.Error {
+	if errors.Is(err, nats.ErrBucketNotFound) || errors.Is(err, nats.ErrStreamNotFound) {
+		return store.NewErrorNoSuchStore()
+	}
+	return store.NewErrorOther(err.Error())
+}
+
+func (h *WasiKvHandler) linkedKv(ctx context.Context, bucket string) (nats.KeyValue, string, *store.Error) {
+	isLinked, target := h.kvHandler.isLinkedWithPackage(ctx, wasiKvPackage)
+	if !isLinked {
+		return nil, "", store.NewErrorAccessDenied()
+	}
+	kv, err := h.kvHandler.getKvByStore(target, bucket)
+	if err != nil {
+		h.kvHandler.provider.Logger.Error("error getting kv", "bucket", bucket, "error", err)
+		return nil, "", natsErrToWasi(err)
+	}
+	return kv, target, nil
+}
+
+func (h *WasiKvHandler) Get(ctx__ context.Context, bucket string, key string) (*wrpc.Result[[]uint8, store.Error], error) {
+	kv, _, witErr := h.linkedKv(ctx__, bucket)
+	if witErr != nil {
+		return wrpc.Err[[]uint8](*witErr), nil
+	}
+	kve, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return wrpc.Ok[store.Error]([]uint8(nil)), nil
+	}
+	if err != nil {
+		return wrpc.Err[[]uint8](*natsErrToWasi(err)), nil
+	}
+	return wrpc.Ok[store.Error](kve.Value()), nil
+}
+
+func (h *WasiKvHandler) Set(ctx__ context.Context, bucket string, key string, value []uint8) (*wrpc.Result[struct{}, store.Error], error) {
+	kv, target, witErr := h.linkedKv(ctx__, bucket)
+	if witErr != nil {
+		return wrpc.Err[struct{}](*witErr), nil
+	}
+	if err := h.kvHandler.validate(target, key, value); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWasi(err)), nil
+	}
+	if _, err := kv.Put(key, value); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWasi(err)), nil
+	}
+	return wrpc.Ok[store.Error](struct{}{}), nil
+}
+
+func (h *WasiKvHandler) Delete(ctx__ context.Context, bucket string, key string) (*wrpc.Result[struct{}, store.Error], error) {
+	kv, _, witErr := h.linkedKv(ctx__, bucket)
+	if witErr != nil {
+		return wrpc.Err[struct{}](*witErr), nil
+	}
+	if err := kv.Delete(key); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWasi(err)), nil
+	}
+	return wrpc.Ok[store.Error](struct{}{}), nil
+}
+
+func (h *WasiKvHandler) Exists(ctx__ context.Context, bucket string, key string) (*wrpc.Result[bool, store.Error], error) {
+	kv, _, witErr := h.linkedKv(ctx__, bucket)
+	if witErr != nil {
+		return wrpc.Err[bool](*witErr), nil
+	}
+	_, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return wrpc.Ok[store.Error](false), nil
+	}
+	if err != nil {
+		return wrpc.Err[bool](*natsErrToWasi(err)), nil
+	}
+	return wrpc.Ok[store.Error](true), nil
+}
+
+// ListKeys uses the cursor as an offset into the lexically sorted keys
+// INFO: an offset can't tell where the page starts without the keys before it, so they're kept while scanning, the keys after the page are not
+func (h *WasiKvHandler) ListKeys(ctx__ context.Context, bucket string, cursor *uint64) (*wrpc.Result[store.KeyResponse, store.Error], error) {
+	kv, _, witErr := h.linkedKv(ctx__, bucket)
+	if witErr != nil {
+		return wrpc.Err[store.KeyResponse](*witErr), nil
+	}
+	keyLister, err := kv.ListKeys(nats.Context(ctx__))
+	if err != nil {
+		return wrpc.Err[store.KeyResponse](*natsErrToWasi(err)), nil
+	}
+	offset := 0
+	if cursor != nil {
+		if *cursor > maxListOffset {
+			return wrpc.Err[store.KeyResponse](*store.NewErrorOther(fmt.Sprintf("cursor %d exceeds the largest offset of %d, list keys with key-value's list-keys-page instead", *cursor, maxListOffset))), nil
+		}
+		offset = int(*cursor)
+	}
+	keys := lowestKeys(keyLister.Keys(), "", offset+defaultPageSize+1)
+	offset = min(offset, len(keys))
+	end := min(offset+defaultPageSize, len(keys))
+	response := store.KeyResponse{Keys: keys[offset:end]}
+	if end < len(keys) {
+		next := uint64(end)
+		response.Cursor = &next
+	}
+	return wrpc.Ok[store.Error](response), nil
+}
+
+// Increment stores counters as decimal strings, see incrementCounter
+func (h *WasiKvHandler) Increment(ctx__ context.Context, bucket string, key string, delta uint64) (*wrpc.Result[uint64, store.Error], error) {
+	kv, target, witErr := h.linkedKv(ctx__, bucket)
+	if witErr != nil {
+		return wrpc.Err[uint64](*witErr), nil
+	}
+	if delta > math.MaxInt64 {
+		return wrpc.Err[uint64](*store.NewErrorOther(fmt.Sprintf("delta %d exceeds the largest counter", delta))), nil
+	}
+	// INFO: counters are shared with key-value, whose increment may have taken them below 0, which a u64 can't return
+	validate := func(value []byte) error {
+		if bytes.HasPrefix(value, []byte("-")) {
+			return fmt.Errorf("%w: counter of key %q would be %s", errNegativeCounter, key, value)
+		}
+		return h.kvHandler.validate(target, key, value)
+	}
+	value, err := incrementCounter(kv, key, int64(delta), validate)
+	if err != nil {
+		return wrpc.Err[uint64](*natsErrToWasi(err)), nil
+	}
+	return wrpc.Ok[store.Error](uint64(value)), nil
+}
+
+// GetMany leaves out missing keys as none
+func (h *WasiKvHandler) GetMany(ctx__ context.Context, bucket string, keys []string) (*wrpc.Result[[]*wrpc.Tuple2[string, []uint8], store.Error], error) {
+	kv, _, witErr := h.linkedKv(ctx__, bucket)
+	if witErr != nil {
+		return wrpc.Err[[]*wrpc.Tuple2[string, []uint8]](*witErr), nil
+	}
+	values := make([]*wrpc.Tuple2[string, []uint8], len(keys))
+	errs := make([]error, len(keys))
+	runBatch(len(keys), func(i int) {
+		kve, err := kv.Get(keys[i])
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return
+		}
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		values[i] = &wrpc.Tuple2[string, []uint8]{V0: keys[i], V1: kve.Value()}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return wrpc.Err[[]*wrpc.Tuple2[string, []uint8]](*natsErrToWasi(err)), nil
+	}
+	return wrpc.Ok[store.Error](values), nil
+}
+
+func (h *WasiKvHandler) SetMany(ctx__ context.Context, bucket string, keyValues []*wrpc.Tuple2[string, []uint8]) (*wrpc.Result[struct{}, store.Error], error) {
+	kv, target, witErr := h.linkedKv(ctx__, bucket)
+	if witErr != nil {
+		return wrpc.Err[struct{}](*witErr), nil
+	}
+	errs := make([]error, len(keyValues))
+	runBatch(len(keyValues), func(i int) {
+		if errs[i] = h.kvHandler.validate(target, keyValues[i].V0, keyValues[i].V1); errs[i] != nil {
+			return
+		}
+		_, errs[i] = kv.Put(keyValues[i].V0, keyValues[i].V1)
+	})
+	if err := errors.Join(errs...); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWasi(err)), nil
+	}
+	return wrpc.Ok[store.Error](struct{}{}), nil
+}
+
+func (h *WasiKvHandler) DeleteMany(ctx__ context.Context, bucket string, keys []string) (*wrpc.Result[struct{}, store.Error], error) {
+	kv, _, witErr := h.linkedKv(ctx__, bucket)
+	if witErr != nil {
+		return wrpc.Err[struct{}](*witErr), nil
+	}
+	errs := make([]error, len(keys))
+	runBatch(len(keys), func(i int) {
+		errs[i] = kv.Delete(keys[i])
+	})
+	if err := errors.Join(errs...); err != nil {
+		return wrpc.Err[struct{}](*natsErrToWasi(err)), nil
+	}
+	return wrpc.Ok[store.Error](struct{}{}), nil
+}
+
+// wasiWatchDelivery maps nats operations onto wasi:keyvalue/watcher, put to on-set and delete and purge to on-delete
+func wasiWatchDelivery(bucket string) watchDeliverFunc {
+	return func(ctx context.Context, client wrpc.Invoker, kvEntry nats.KeyValueEntry) error {
+		switch kvEntry.Operation() {
+		case nats.KeyValuePut:
+			return watcher.OnSet(ctx, client, bucket, kvEntry.Key(), kvEntry.Value())
+		default:
+			return watcher.OnDelete(ctx, client, bucket, kvEntry.Key())
+		}
+	}
+}